@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/antitree/go-pillage-registries/pkg/pillage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneMaxSize string
+	pruneAll     bool
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and prune the layer cache",
+	Long:  "Inspect and prune the persistent layer cache selected with --cache.",
+}
+
+var cacheInfoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Show the size of the layer cache",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cache := openCacheDir()
+		size, layers, err := cache.Size()
+		if err != nil {
+			log.Fatalf("failed to read layer cache: %v", err)
+		}
+		fmt.Printf("%s: %d layers, %d bytes\n", cache.Dir(), layers, size)
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Evict least recently used layers from the cache",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if pruneAll == (pruneMaxSize != "") {
+			log.Fatal("pass either --max-size to shrink the cache or --all to empty it")
+		}
+		maxSize, err := pillage.ParseSize(pruneMaxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cache := openCacheDir()
+		removed, freed, err := cache.Prune(maxSize)
+		if err != nil {
+			log.Fatalf("failed to prune layer cache: %v", err)
+		}
+		fmt.Printf("Removed %d layers, freed %d bytes\n", removed, freed)
+	},
+}
+
+func init() {
+	cachePruneCmd.Flags().StringVar(&pruneMaxSize, "max-size", "", "Size to shrink the cache to, e.g. 10GB.")
+	cachePruneCmd.Flags().BoolVar(&pruneAll, "all", false, "Remove every layer from the cache.")
+	cacheCmd.AddCommand(cacheInfoCmd, cachePruneCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
+
+func openCacheDir() *pillage.LayerCache {
+	if cachePath == "." {
+		log.Fatal("no layer cache selected; pass the cache directory with --cache")
+	}
+	cache, err := pillage.OpenLayerCache(cachePath, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cache
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/antitree/go-pillage-registries/pkg/pillage"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/spf13/cobra"
+)
+
+var diffJSON bool
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <image A> <image B>",
+	Short: "Show what changed between two tags or digests of an image",
+	Long: "Compare two images, e.g. app:1.4 and app:1.5 or a staging and a production tag.\n" +
+		"Files added, removed and modified are listed with their SHA256, along with changes to the\n" +
+		"env, labels, entrypoint, cmd, user, workdir and exposed ports of the config, and the findings\n" +
+		"of image B that image A does not have. The layers both images start with are skipped.",
+	Example: "  pilreg diff -i --scan-secrets 127.0.0.1:5000/app:1.4 127.0.0.1:5000/app:1.5\n" +
+		"  pilreg diff registry.example.com/app:staging registry.example.com/app@sha256:<digest> --json",
+	Args: cobra.ExactArgs(2),
+	Run:  runDiff,
+}
+
+func init() {
+	diffCmd.Flags().BoolVar(&diffJSON, "json", false, "Print the diff as JSON.")
+	rootCmd.AddCommand(diffCmd)
+}
+
+func runDiff(cmd *cobra.Command, args []string) {
+	pillage.SetDebug(debug)
+	if skiptls {
+		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	var auth authn.Authenticator
+	if token != "" {
+		if username == "" {
+			username = "pilreg"
+		}
+		auth = authn.FromConfig(authn.AuthConfig{Username: username, Password: token})
+	}
+	craneoptions := pillage.ShareTransport(pillage.MakeCraneOptions(insecure, auth))
+
+	images := make([]*pillage.ImageData, len(args))
+	for i, ref := range args {
+		image, err := pillage.FetchImage(ref, craneoptions...)
+		if err != nil {
+			log.Fatalf("failed to fetch %s: %v", ref, err)
+		}
+		images[i] = image
+	}
+
+	layerCache, cleanup, err := openLayerCache()
+	if err != nil {
+		log.Fatalf("failed to open layer cache: %v", err)
+	}
+	defer cleanup()
+
+	diff, err := pillage.DiffImages(images[0], images[1], &pillage.StorageOptions{
+		CachePath:    cachePath,
+		CraneOptions: craneoptions,
+		Auth:         auth,
+		LayerWorkers: layerWorkers,
+		FetchForeign: fetchForeign,
+		ScanSecrets:  scanSecrets,
+		Cache:        layerCache,
+		Limits: pillage.LayerLimits{
+			MaxLayerBytes: parseSizeFlag("max-uncompressed", maxUncompress),
+			MaxEntries:    maxEntries,
+			MaxFileSize:   parseSizeFlag("max-file-size", maxFileSize),
+			MaxPathLength: maxPathLength,
+			MaxRatio:      maxRatio,
+		},
+	})
+	if err != nil {
+		log.Fatalf("diff failed: %v", err)
+	}
+	if diffJSON {
+		printJSON(diff)
+		return
+	}
+	if err := diff.WriteText(os.Stdout); err != nil {
+		log.Fatalf("failed to write the diff: %v", err)
+	}
+}
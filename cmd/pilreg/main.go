@@ -2,13 +2,13 @@ package main
 
 import (
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/google/go-containerregistry/pkg/authn"
@@ -28,15 +28,35 @@ var (
 	skiptls        bool
 	insecure       bool
 	storeImages    bool
+	storeTarballs  bool
+	fetchForeign   bool
 	registry       string
 	cachePath      string
+	cacheMaxSize   string
 	outputPath     string
 	workerCount    int
+	layerWorkers   int
 	truffleHog     bool
 	whiteOut       bool
+	shadowed       bool
+	scanSecrets    bool
 	whiteOutFilter []string
-	filterSmall    int64
+	maxLayerSize   string
+	minLayerSize   string
+	maxImageSize   string
+	maxUncompress  string
+	maxEntries     int64
+	maxFileSize    string
+	maxPathLength  int64
+	maxRatio       float64
+	imageBudget    string
+	runBudget      string
+	retryFailed    bool
 	showVersion    bool
+	jsonl          bool
+	format         string
+	imageColumns   []string
+	findingColumns []string
 	debug          bool
 	all            bool   // Enable all analysis options by default
 	token          string // Bearer token or password for auth
@@ -62,13 +82,33 @@ func init() {
 	storageFlags := pflag.NewFlagSet("Storage Options", pflag.ContinueOnError)
 	storageFlags.StringVarP(&outputPath, "output", "o", ".", "Directory to store output. Required with --store-images.(./results/ by default)")
 	storageFlags.BoolVarP(&storeImages, "store-images", "s", false, "Download and store image filesystems.")
+	storageFlags.BoolVar(&storeTarballs, "tarballs", false, "Store each layer's tarball as filesystem.tar next to its extracted files.")
+	storageFlags.BoolVar(&fetchForeign, "fetch-foreign", false, "Fetch non-distributable (foreign) layers from the URLs in their descriptor.")
 	storageFlags.StringVarP(&cachePath, "cache", "c", ".", "Path to cache image layers. (/tmp by default)")
+	storageFlags.StringVar(&cacheMaxSize, "cache-max-size", "", "Evict least recently used layers once the cache exceeds this size, e.g. 20GB.")
+	storageFlags.StringVar(&maxLayerSize, "max-layer-size", "", "Skip layers larger than this size, e.g. 500MB. The image is left partial and scanned again by later runs.")
+	storageFlags.StringVar(&minLayerSize, "min-layer-size", "", "Skip layers smaller than this size. The image is left partial and scanned again by later runs.")
+	storageFlags.StringVar(&maxImageSize, "max-image-size", "", "Skip images whose layers add up to more than this size. The image is left partial and scanned again by later runs.")
+	storageFlags.StringVar(&maxUncompress, "max-uncompressed", "", "Stop reading a layer once it decompresses to more than this size. (64GB by default)")
+	storageFlags.Int64Var(&maxEntries, "max-entries", 0, "Stop reading a layer after this many tar entries. (2000000 by default)")
+	storageFlags.StringVar(&maxFileSize, "max-file-size", "", "Stop reading a layer at a file larger than this size. (32GB by default)")
+	storageFlags.Int64Var(&maxPathLength, "max-path-length", 0, "Stop reading a layer at a path longer than this. (4096 by default)")
+	storageFlags.Float64Var(&maxRatio, "max-ratio", 0, "Stop reading a layer that decompresses to more than this many times its size. (500 by default)")
+	storageFlags.StringVar(&imageBudget, "image-budget", "", "Download at most this many layer bytes per image. The image is left partial and scanned again by later runs.")
+	storageFlags.StringVar(&runBudget, "run-budget", "", "Download at most this many layer bytes in total. Images left partial are scanned again by later runs.")
+	storageFlags.BoolVar(&retryFailed, "retry-failed", false, "Only rescan images that failed or were interrupted in a previous run.")
+	storageFlags.BoolVar(&jsonl, "jsonl", false, "Stream image metadata to stdout as JSON Lines. Logs go to stderr.")
+	storageFlags.StringVar(&format, "format", "", "Export format: 'csv' writes images.csv and findings.csv to the output directory, 'jsonl' is the same as --jsonl.")
+	storageFlags.StringSliceVar(&imageColumns, "image-columns", nil, "Columns of images.csv. Defaults to "+strings.Join(pillage.ImageColumns, ",")+".")
+	storageFlags.StringSliceVar(&findingColumns, "finding-columns", nil, "Columns of findings.csv. Defaults to "+strings.Join(pillage.FindingColumns, ",")+".")
 	rootCmd.PersistentFlags().AddFlagSet(storageFlags)
 
 	// Analysis config options
 	analysisFlags := pflag.NewFlagSet("Analysis Options", pflag.ContinueOnError)
 	analysisFlags.BoolVarP(&truffleHog, "trufflehog", "x", false, "Scan image contents with TruffleHog.")
 	analysisFlags.BoolVarP(&whiteOut, "whiteout", "w", false, "Look for deleted/whiteout files in image layers.")
+	analysisFlags.BoolVar(&shadowed, "shadowed", false, "Restore file versions overwritten by a later layer, with a diff.")
+	analysisFlags.BoolVar(&scanSecrets, "scan-secrets", false, "Look for private keys, tokens and passwords in layer files with built-in patterns.")
 	analysisFlags.StringSliceVar(&whiteOutFilter, "whiteout-filter", nil, "Filter patterns when extracting whiteouts. Defaults to 'tmp,cache,apk,apt'.")
 	analysisFlags.Lookup("whiteout-filter").NoOptDefVal = "tmp,cache,apk,apt,downloaded_packages,dist-info,site-packages,mssql-tools/bin,*/tmp/downloaded_packages/**,*/wheels/**,*/site-packages/**,*/.dist-info/**,*/opt/*-tmp/**,*/usr/share/info/**,*/mssql-tools/bin/**"
 	analysisFlags.BoolVarP(&all, "all", "a", true, "Enable all analysis options by default. (Very noisy!)")
@@ -82,6 +122,7 @@ func init() {
 	connFlags.StringVar(&token, "token", "", "Registry bearer token or password")
 	connFlags.StringVar(&username, "username", "", "Username for token auth (default 'pilreg' if omitted)")
 	connFlags.IntVar(&workerCount, "workers", 8, "Number of concurrent workers.")
+	connFlags.IntVar(&layerWorkers, "layer-workers", 3, "Number of layers downloaded at once for each image.")
 	connFlags.BoolVar(&showVersion, "version", false, "Print version information and exit.")
 	connFlags.BoolVarP(&debug, "debug", "d", false, "Enable debug logging.")
 	rootCmd.PersistentFlags().AddFlagSet(connFlags)
@@ -101,12 +142,6 @@ var rootCmd = &cobra.Command{
 
 // NormalizeFlags applies implicit behavior for CLI combinations.
 func NormalizeFlags() {
-	if cachePath != "" && !storeImages {
-		storeImages = true
-	}
-	if truffleHog && !storeImages {
-		storeImages = true
-	}
 	if len(whiteOutFilter) > 0 {
 		whiteOut = true
 	}
@@ -125,8 +160,7 @@ func NormalizeFlags() {
 	if whiteOut && outputPath == "." {
 		log.Println("⚠️  --whiteout was set without --output or -o. Layers will be processed in memory.")
 	}
-	if storeImages && outputPath == "." {
-		outputPath = "."
+	if (storeImages || storeTarballs) && outputPath == "." {
 		pillage.LogWarn("--store-images requires output. Setting it to the current directory")
 	}
 }
@@ -134,6 +168,14 @@ func NormalizeFlags() {
 func run(cmd *cobra.Command, registries []string) {
 	pillage.SetDebug(debug)
 
+	switch format {
+	case "", "csv":
+	case "jsonl":
+		jsonl = true
+	default:
+		log.Fatalf("unsupported --format %q (use csv or jsonl)", format)
+	}
+
 	if showVersion {
 		fmt.Printf("pilreg %s (%s)\n", version, buildDate)
 		return
@@ -155,12 +197,23 @@ func run(cmd *cobra.Command, registries []string) {
 
 	NormalizeFlags()
 
-	indexFile := filepath.Join(outputPath, "scanned_shas.log")
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		log.Fatalf("failed to create output directory: %v", err)
+	}
 	var err error
-	hashIndex, err = pillage.NewHashIndex(indexFile)
+	hashIndex, err = pillage.NewHashIndex(filepath.Join(outputPath, "scan_state.jsonl"))
 	if err != nil {
 		log.Fatalf("failed to init hash index: %v", err)
 	}
+	if err := hashIndex.ImportLegacy(filepath.Join(outputPath, "scanned_shas.log")); err != nil {
+		log.Printf("failed importing scanned_shas.log: %v", err)
+	}
+
+	scanDB, err := pillage.OpenScanDB(filepath.Join(outputPath, pillage.DBFile), false)
+	if err != nil {
+		log.Fatalf("failed to open scan database: %v", err)
+	}
+	defer scanDB.Close()
 
 	if skiptls {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
@@ -200,16 +253,41 @@ func run(cmd *cobra.Command, registries []string) {
 		}
 	}
 
-	craneoptions := pillage.MakeCraneOptions(insecure, auth)
+	craneoptions := pillage.ShareTransport(pillage.MakeCraneOptions(insecure, auth))
+
+	layerCache, cleanup, err := openLayerCache()
+	if err != nil {
+		log.Fatalf("failed to open layer cache: %v", err)
+	}
+	defer cleanup()
 
 	storageOptions := &pillage.StorageOptions{
 		StoreImages:    storeImages,
+		StoreTarballs:  storeTarballs,
+		FetchForeign:   fetchForeign,
 		CachePath:      cachePath,
 		OutputPath:     outputPath,
 		CraneOptions:   craneoptions,
+		Auth:           auth,
+		LayerWorkers:   layerWorkers,
 		WhiteOut:       whiteOut,
+		Shadowed:       shadowed,
+		ScanSecrets:    scanSecrets,
 		WhiteOutFilter: whiteOutFilter,
-		FilterSmall:    filterSmall,
+		FilterSmall:    parseSizeFlag("max-layer-size", maxLayerSize),
+		MinLayerSize:   parseSizeFlag("min-layer-size", minLayerSize),
+		MaxImageSize:   parseSizeFlag("max-image-size", maxImageSize),
+		ImageBudget:    parseSizeFlag("image-budget", imageBudget),
+		Budget:         pillage.NewDownloadBudget(parseSizeFlag("run-budget", runBudget)),
+		DB:             scanDB,
+		Cache:          layerCache,
+		Limits: pillage.LayerLimits{
+			MaxLayerBytes: parseSizeFlag("max-uncompressed", maxUncompress),
+			MaxEntries:    maxEntries,
+			MaxFileSize:   parseSizeFlag("max-file-size", maxFileSize),
+			MaxPathLength: maxPathLength,
+			MaxRatio:      maxRatio,
+		},
 	}
 
 	var images <-chan *pillage.ImageData
@@ -222,46 +300,190 @@ func run(cmd *cobra.Command, registries []string) {
 		images = pillage.EnumRegistries(registries, repos, tags, craneoptions...)
 	}
 
-	var results []*pillage.ImageData
+	var jsonlWriter *pillage.JSONLWriter
+	if jsonl {
+		jsonlWriter = pillage.NewJSONLWriter(os.Stdout)
+	}
+	var csvWriter *pillage.CSVWriter
+	if format == "csv" {
+		csvWriter, err = pillage.NewCSVWriter(outputPath, imageColumns, findingColumns)
+		if err != nil {
+			log.Fatalf("failed to create CSV export: %v", err)
+		}
+		defer csvWriter.Close()
+	}
+
+	runTruffleHog := truffleHog && CheckTrufflehogInstalled()
+	profile := scanProfile(runTruffleHog)
 	wg := sizedwaitgroup.New(workerCount)
 
+	scannedRepos := map[[2]string]bool{}
 	for image := range images {
+		scannedRepos[[2]string{image.Registry, image.Repository}] = true
+		if jsonlWriter != nil {
+			if err := jsonlWriter.Write(image); err != nil {
+				log.Printf("failed writing JSON line for %s: %v", image.Reference, err)
+			}
+		}
 
 		hash := pillage.ImageHash(image)
-		exists, err := hashIndex.AddIfMissing(hash)
+		scan, err := hashIndex.Claim(hash, image.Reference, profile, retryFailed)
 		if err != nil {
-			log.Printf("failed recording hash: %v", err)
+			log.Printf("failed recording scan state: %v", err)
 		}
-		if exists {
+		if !scan {
 			pillage.LogInfo("Skipping already scanned image %s", image.Reference)
 			continue
 		}
 
-		if outputPath == "." && !whiteOut {
-			results = append(results, image)
-		} else {
-			wg.Add()
-			go func(img *pillage.ImageData) {
-				img.Store(storageOptions)
-				wg.Done()
-			}(image)
-		}
+		wg.Add()
+		go func(img *pillage.ImageData) {
+			defer wg.Done()
+			if err := hashIndex.SetState(hash, pillage.StateInProgress, ""); err != nil {
+				log.Printf("failed recording scan state: %v", err)
+			}
+			var failures []string
+			if outputPath != "." || whiteOut || shadowed || scanSecrets || storeImages || storeTarballs {
+				if err := img.Store(storageOptions); err != nil {
+					failures = append(failures, err.Error())
+				}
+				if cachePath == "." {
+					// The temporary cache only keeps the layers of images
+					// still being stored.
+					if _, _, err := layerCache.Prune(0); err != nil {
+						pillage.LogWarn("Failed to prune layer cache: %v", err)
+					}
+				}
+			} else if img.Error != nil {
+				failures = append(failures, img.Error.Error())
+			}
+			for _, le := range img.FailedLayers() {
+				failures = append(failures, fmt.Sprintf("layer %d (%s): %s", le.Index, le.Digest, le.Error))
+			}
+			if runTruffleHog {
+				if err := pillage.RunTruffleHog(img); err != nil {
+					failures = append(failures, "trufflehog: "+err.Error())
+				}
+			}
+			img.Findings = append(img.Findings, pillage.AuditConfig(img)...)
+			if err := img.WriteResults(outputPath); err != nil {
+				pillage.LogWarn("Failed writing results for %s: %v", img.Reference, err)
+			}
+			if err := scanDB.RecordImage(img); err != nil {
+				pillage.LogWarn("Failed recording %s in the scan database: %v", img.Reference, err)
+			}
+			if csvWriter != nil {
+				if err := csvWriter.Write(pillage.NewImageRecord(img), img.Findings); err != nil {
+					pillage.LogWarn("Failed writing CSV rows for %s: %v", img.Reference, err)
+				}
+			}
+
+			state, reason := pillage.StateComplete, ""
+			if deferred := img.DeferredLayers(); len(deferred) > 0 {
+				state, reason = pillage.StatePartial, fmt.Sprintf("%d layers left for a later run: %s", len(deferred), deferred[0].Error)
+			}
+			if len(failures) > 0 {
+				state, reason = pillage.StateFailed, strings.Join(failures, "; ")
+			}
+			if err := hashIndex.SetState(hash, state, reason); err != nil {
+				log.Printf("failed recording scan state: %v", err)
+			}
+		}(image)
+	}
+
+	wg.Wait()
 
-		if truffleHog && CheckTrufflehogInstalled() {
-			go pillage.RunTruffleHog(image)
+	if whiteOut {
+		analyzeTags(scanDB, layerCache, scannedRepos)
+	}
+}
+
+// analyzeTags reports the files and secrets that disappear between the tags of
+// every scanned repository, from the layer inventories of the scan.
+func analyzeTags(db *pillage.ScanDB, cache *pillage.LayerCache, repos map[[2]string]bool) {
+	keys := make([][2]string, 0, len(repos))
+	for repo := range repos {
+		keys = append(keys, repo)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i][0]+"/"+keys[i][1] < keys[j][0]+"/"+keys[j][1] })
+	for _, repo := range keys {
+		analysis, err := pillage.AnalyzeTags(db, cache, repo[0], repo[1])
+		if err != nil {
+			pillage.LogWarn("Failed comparing the tags of %s/%s: %v", repo[0], repo[1], err)
+			continue
+		}
+		if len(analysis.Tags) < 2 {
+			continue
 		}
+		if err := analysis.Write(outputPath, db); err != nil {
+			pillage.LogWarn("Failed writing the tag comparison of %s/%s: %v", repo[0], repo[1], err)
+		}
+		if secrets := len(analysis.Findings()); len(analysis.Removed) > 0 {
+			pillage.LogInfo("%s/%s: %d files and %d secrets removed between tags are still in older tags", repo[0], repo[1], len(analysis.Removed), secrets)
+		}
+	}
+}
 
+// parseSizeFlag parses the value of a size flag such as --max-layer-size.
+func parseSizeFlag(flag, value string) int64 {
+	n, err := pillage.ParseSize(value)
+	if err != nil {
+		log.Fatalf("invalid --%s: %v", flag, err)
 	}
+	return n
+}
 
-	wg.Wait()
+// scanProfile lists the analyses and stored outputs enabled for this run.
+// Images scanned with a profile lacking any of them are scanned again.
+func scanProfile(runTruffleHog bool) []string {
+	var profile []string
+	if storeImages {
+		profile = append(profile, "store-images")
+	}
+	if storeTarballs {
+		profile = append(profile, "tarballs")
+	}
+	if fetchForeign {
+		profile = append(profile, "fetch-foreign")
+	}
+	if whiteOut {
+		profile = append(profile, "whiteout")
+	}
+	if shadowed {
+		profile = append(profile, "shadowed")
+	}
+	if scanSecrets {
+		profile = append(profile, "scan-secrets")
+	}
+	if runTruffleHog {
+		profile = append(profile, "trufflehog")
+	}
+	return profile
+}
 
-	if outputPath == "" {
-		out, err := json.Marshal(results)
+// openLayerCache opens the layer cache at --cache. Without --cache the layers
+// are cached in a temporary directory that is removed by the returned cleanup,
+// and which the scan empties after each image.
+func openLayerCache() (*pillage.LayerCache, func(), error) {
+	maxSize, err := pillage.ParseSize(cacheMaxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir := cachePath
+	cleanup := func() {}
+	if dir == "." {
+		dir, err = os.MkdirTemp("", "pilreg-cache-")
 		if err != nil {
-			log.Fatalf("error formatting results for %s: %v", registry, err)
+			return nil, nil, err
 		}
-		fmt.Println(string(out))
+		cleanup = func() { os.RemoveAll(dir) }
+	}
+	cache, err := pillage.OpenLayerCache(dir, maxSize)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
 	}
+	return cache, cleanup, nil
 }
 
 // CheckTrufflehogInstalled verifies if trufflehog is in the system PATH
@@ -277,6 +499,24 @@ func CheckTrufflehogInstalled() bool {
 // SetHelpFunc prints grouped help output for categorized flags
 func init() {
 	rootCmd.SetHelpFunc(func(cmd *cobra.Command, args []string) {
+		if cmd != rootCmd {
+			// Subcommands only list their own flags; the global flag list is long.
+			fmt.Printf("Usage: %s\n\n", cmd.UseLine())
+			if cmd.Long != "" {
+				fmt.Printf("%s\n\n", cmd.Long)
+			}
+			if cmd.HasAvailableSubCommands() {
+				fmt.Println("Commands:")
+				for _, c := range cmd.Commands() {
+					if c.IsAvailableCommand() {
+						fmt.Printf("  %-24s %s\n", c.Name(), c.Short)
+					}
+				}
+				fmt.Println()
+			}
+			fmt.Printf("Flags:\n%s", cmd.NonInheritedFlags().FlagUsages())
+			return
+		}
 		fmt.Print("Usage: pilreg [OPTIONS] <registry>\n\n")
 		fmt.Println("pilreg is penetration testing tool targeting container images hosted in a registry or in a tar ball.")
 
@@ -288,18 +528,29 @@ func init() {
 		fmt.Println("  pilreg --local <path/to/tarball.tar> --whiteout")
 		fmt.Println("  pilreg --local <path/to/tarball.tar> --whiteout-filter=apk,tmp,test")
 		fmt.Println("  pilreg <registry> --trufflehog")
+		fmt.Println("  pilreg <registry> --jsonl | jq .config")
+		fmt.Println("  pilreg <registry> -o <output dir> --format csv --image-columns repo,tag,digest")
+		fmt.Println("  pilreg report -o <output dir> --html")
+		fmt.Println("  pilreg diff <registry>/app:1.4 <registry>/app:1.5")
+
+		fmt.Println("\n Commands:")
+		for _, c := range cmd.Commands() {
+			if c.IsAvailableCommand() {
+				fmt.Printf("  %-24s %s\n", c.Name(), c.Short)
+			}
+		}
 
 		fmt.Println("\n Registry/Local config options:")
 		printFlags(cmd, []string{"repos", "tags", "local"})
 
 		fmt.Println("\n Storage config options:")
-		printFlags(cmd, []string{"output", "store-images", "cache", "small"})
+		printFlags(cmd, []string{"output", "store-images", "tarballs", "fetch-foreign", "cache", "cache-max-size", "max-layer-size", "min-layer-size", "max-image-size", "max-uncompressed", "max-entries", "max-file-size", "max-path-length", "max-ratio", "image-budget", "run-budget", "retry-failed", "jsonl", "format", "image-columns", "finding-columns"})
 
 		fmt.Println("\n Analysis config options:")
-		printFlags(cmd, []string{"trufflehog", "whiteout", "whiteout-filter"})
+		printFlags(cmd, []string{"trufflehog", "whiteout", "shadowed", "scan-secrets", "whiteout-filter"})
 
 		fmt.Println("\n Connection options:")
-		printFlags(cmd, []string{"skip-tls", "insecure", "token", "username", "workers"})
+		printFlags(cmd, []string{"skip-tls", "insecure", "token", "username", "workers", "layer-workers"})
 
 		fmt.Println("")
 		printFlags(cmd, []string{"version"})
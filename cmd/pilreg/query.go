@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/antitree/go-pillage-registries/pkg/pillage"
+	"github.com/spf13/cobra"
+)
+
+var queryJSON bool
+
+var queryCmd = &cobra.Command{
+	Use:   "query",
+	Short: "Query the scan database of previous runs",
+	Long: "Query the scan database (pilreg.db) in the --output directory.\n" +
+		"Results are answered from earlier scans without contacting the registry.",
+}
+
+var queryFileCmd = &cobra.Command{
+	Use:   "file <path or glob>",
+	Short: "List images whose layers contain a path, e.g. /root/.ssh/id_rsa",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openQueryDB()
+		defer db.Close()
+		matches, err := db.FindFiles(args[0])
+		if err != nil {
+			log.Fatalf("query failed: %v", err)
+		}
+		if queryJSON {
+			printJSON(matches)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tSIZE\tLAYER\tIMAGE")
+		for _, m := range matches {
+			for _, use := range m.Images {
+				fmt.Fprintf(w, "/%s\t%d\t%d:%s\t%s\n", m.Path, m.Size, use.Index, m.Layer, use.Reference)
+			}
+		}
+		w.Flush()
+	},
+}
+
+var queryLayerCmd = &cobra.Command{
+	Use:   "layer <digest>",
+	Short: "List the images and tags that share a layer",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openQueryDB()
+		defer db.Close()
+		uses, err := db.ImagesWithLayer(args[0])
+		if err != nil {
+			log.Fatalf("query failed: %v", err)
+		}
+		if queryJSON {
+			printJSON(uses)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "IMAGE\tLAYER INDEX")
+		for _, use := range uses {
+			fmt.Fprintf(w, "%s\t%d\n", use.Reference, use.Index)
+		}
+		w.Flush()
+	},
+}
+
+var queryImagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "List all recorded images",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openQueryDB()
+		defer db.Close()
+		images, err := db.Images()
+		if err != nil {
+			log.Fatalf("query failed: %v", err)
+		}
+		if queryJSON {
+			printJSON(images)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "IMAGE\tDIGEST\tPLATFORM\tERROR")
+		for _, img := range images {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", img.Reference, img.Digest, img.Platform, img.Error)
+		}
+		w.Flush()
+	},
+}
+
+var queryFindingsCmd = &cobra.Command{
+	Use:   "findings [image reference]",
+	Short: "List recorded findings, optionally for a single image",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openQueryDB()
+		defer db.Close()
+		var ref string
+		if len(args) == 1 {
+			ref = args[0]
+		}
+		findings, err := db.Findings(ref)
+		if err != nil {
+			log.Fatalf("query failed: %v", err)
+		}
+		if queryJSON {
+			printJSON(findings)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SEVERITY\tTYPE\tIMAGE\tPATH\tDESCRIPTION")
+		for _, f := range findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Severity, f.Type, f.Image, f.Path, f.Description)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	queryCmd.PersistentFlags().BoolVar(&queryJSON, "json", false, "Print results as JSON.")
+	queryCmd.AddCommand(queryFileCmd, queryLayerCmd, queryImagesCmd, queryFindingsCmd)
+	rootCmd.AddCommand(queryCmd)
+}
+
+func openQueryDB() *pillage.ScanDB {
+	path := filepath.Join(outputPath, pillage.DBFile)
+	if _, err := os.Stat(path); err != nil {
+		log.Fatalf("no scan database found: %v", err)
+	}
+	db, err := pillage.OpenScanDB(path, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatalf("failed to encode results: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/antitree/go-pillage-registries/pkg/pillage"
+	"github.com/antitree/go-pillage-registries/pkg/report"
+	"github.com/spf13/cobra"
+)
+
+var (
+	reportHTML     bool
+	reportMarkdown bool
+	reportTemplate string
+	reportFile     string
+	showSecrets    bool
+)
+
+var reportCmd = &cobra.Command{
+	Use:   "report [scan directory]",
+	Short: "Generate a report from the results of a previous scan",
+	Long: "Generate a report from a scan output directory. The scan directory defaults to --output.\n" +
+		"Reports are built from the saved results, so they can be regenerated without rescanning.\n" +
+		"Use --format csv with --image-columns and --finding-columns to export spreadsheets.",
+	Args: cobra.MaximumNArgs(1),
+	Run:  runReport,
+}
+
+func init() {
+	reportCmd.Flags().BoolVar(&reportHTML, "html", false, "Write a self-contained HTML report.")
+	reportCmd.Flags().BoolVar(&reportMarkdown, "markdown", false, "Write a Markdown report.")
+	reportCmd.Flags().StringVar(&reportTemplate, "template", "", "Write a report using a custom text/template file.")
+	reportCmd.Flags().BoolVar(&showSecrets, "show-secrets", false, "Embed plaintext secrets in the HTML report behind a reveal button. Secrets are redacted otherwise.")
+	reportCmd.Flags().StringVarP(&reportFile, "file", "f", "", "Report file to write, or the directory for --format csv. Defaults to the scan directory.")
+	rootCmd.AddCommand(reportCmd)
+}
+
+func runReport(cmd *cobra.Command, args []string) {
+	dir := outputPath
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	if format == "csv" {
+		rep, err := report.Load(dir)
+		if err != nil {
+			log.Fatalf("failed to load scan results: %v", err)
+		}
+		outDir := dir
+		if reportFile != "" {
+			outDir = reportFile
+		}
+		if err := report.WriteCSV(outDir, rep, imageColumns, findingColumns); err != nil {
+			log.Fatalf("failed to write CSV export: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "CSV export written to %s and %s\n", filepath.Join(outDir, pillage.ImagesCSV), filepath.Join(outDir, pillage.FindingsCSV))
+		return
+	}
+
+	var ext string
+	var write func(io.Writer, *report.Report) error
+	switch {
+	case reportTemplate != "":
+		ext = filepath.Ext(strings.TrimSuffix(reportTemplate, ".tmpl"))
+		if ext == "" {
+			ext = ".txt"
+		}
+		write = func(w io.Writer, r *report.Report) error {
+			return report.WriteTemplateFile(w, r, reportTemplate)
+		}
+	case reportMarkdown:
+		ext, write = ".md", report.WriteMarkdown
+	case reportHTML:
+		ext, write = ".html", report.WriteHTML
+	default:
+		cmd.Help()
+		return
+	}
+
+	rep, err := report.Load(dir)
+	if err != nil {
+		log.Fatalf("failed to load scan results: %v", err)
+	}
+	rep.ShowSecrets = showSecrets
+
+	path := reportFile
+	if path == "" {
+		path = filepath.Join(dir, "report"+ext)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("failed to create report %s: %v", path, err)
+	}
+	defer f.Close()
+	if err := write(f, rep); err != nil {
+		log.Fatalf("failed to write report: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Report written to %s\n", path)
+}
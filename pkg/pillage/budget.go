@@ -0,0 +1,89 @@
+package pillage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DownloadBudget caps the number of layer bytes downloaded. It is safe for
+// concurrent use so a single budget can be shared by all images of a run. A
+// nil budget or a zero limit is unlimited.
+type DownloadBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// NewDownloadBudget returns a budget of limit bytes.
+func NewDownloadBudget(limit int64) *DownloadBudget {
+	return &DownloadBudget{limit: limit}
+}
+
+// Reserve takes n bytes from the budget. It returns false, without taking
+// anything, when the budget cannot cover them.
+func (b *DownloadBudget) Reserve(n int64) bool {
+	if b == nil || b.limit <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// release returns n reserved bytes to the budget.
+func (b *DownloadBudget) release(n int64) {
+	if b == nil || b.limit <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+// Used returns the bytes reserved so far.
+func (b *DownloadBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// skipLayer returns why a layer of the given size should not be processed, or
+// an empty string. Layers skipped by a size limit or a budget are deferred:
+// the image is left partial and a later run reads them, with larger limits or
+// a fresh budget. The per-image and per-run budgets are charged for layers
+// that are processed and not already in the layer cache; reserved is the
+// amount to refund if the download fails.
+func (opts *StorageOptions) skipLayer(digest string, size int64, imageBudget *DownloadBudget) (reason string, reserved int64) {
+	if opts.FilterSmall > 0 && size > opts.FilterSmall {
+		return fmt.Sprintf("layer size %d exceeds the maximum layer size %d", size, opts.FilterSmall), 0
+	}
+	if opts.MinLayerSize > 0 && size < opts.MinLayerSize {
+		return fmt.Sprintf("layer size %d is below the minimum layer size %d", size, opts.MinLayerSize), 0
+	}
+	// The image pins its layers, so a cached layer is kept until it is read.
+	if opts.Cache != nil && opts.Cache.Has(digest) {
+		return "", 0
+	}
+	if !imageBudget.Reserve(size) {
+		return fmt.Sprintf("image download budget of %d bytes exhausted", imageBudget.limit), 0
+	}
+	if !opts.Budget.Reserve(size) {
+		imageBudget.release(size)
+		return fmt.Sprintf("run download budget of %d bytes exhausted", opts.Budget.limit), 0
+	}
+	return "", size
+}
+
+// refund returns the budget reserved by skipLayer for a layer that was not
+// downloaded after all.
+func (opts *StorageOptions) refund(reserved int64, imageBudget *DownloadBudget) {
+	imageBudget.release(reserved)
+	opts.Budget.release(reserved)
+}
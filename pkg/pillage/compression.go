@@ -0,0 +1,198 @@
+package pillage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Layer compression formats.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Memory bounds of the zstd decoder, so a hostile frame header cannot make it
+// allocate a huge window. 128MB is the window of zstd --long, the largest
+// used by common tools.
+const (
+	zstdMaxWindow = 128 << 20
+	zstdMaxMemory = 256 << 20
+)
+
+// layerMediaTypes maps the supported layer media types to their compression.
+// eStargz layers use the gzip media types and are plain gzip streams to a
+// reader that ignores their table of contents.
+var layerMediaTypes = map[string]string{
+	"application/vnd.docker.image.rootfs.diff.tar.gzip": CompressionGzip,
+	"application/vnd.docker.image.rootfs.diff.tar":      CompressionNone,
+	"application/vnd.oci.image.layer.v1.tar+gzip":       CompressionGzip,
+	"application/vnd.oci.image.layer.v1.tar+zstd":       CompressionZstd,
+	"application/vnd.oci.image.layer.v1.tar":            CompressionNone,
+}
+
+// foreignMediaTypes maps the layers that registries usually do not serve, such
+// as Windows base layers, to their compression. They must be fetched from the
+// URLs in their descriptor.
+var foreignMediaTypes = map[string]string{
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    CompressionGzip,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar":      CompressionNone,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": CompressionGzip,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": CompressionZstd,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar":         CompressionNone,
+}
+
+// mediaTypeCompression returns the compression a layer media type declares, or
+// an empty string for an empty or unknown media type.
+func mediaTypeCompression(mediaType string) string {
+	if c, ok := layerMediaTypes[mediaType]; ok {
+		return c
+	}
+	return foreignMediaTypes[mediaType]
+}
+
+// LayerError records a layer of an image that was not processed, either
+// because it failed or because it was skipped on purpose.
+type LayerError struct {
+	Index     int    `json:"index"`
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType,omitempty"`
+	Error     string `json:"error"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	// URLs a foreign layer is served from instead of the registry.
+	URLs []string `json:"urls,omitempty"`
+	// Limit is the LayerLimits limit the layer exceeded.
+	Limit string `json:"limit,omitempty"`
+	// Deferred layers were skipped by the maximum image size or a download
+	// budget. They are read when the image is scanned again.
+	Deferred bool `json:"deferred,omitempty"`
+}
+
+func (image *ImageData) addLayerError(index int, digest, mediaType, msg string, skipped bool, urls ...string) {
+	image.LayerErrors = append(image.LayerErrors, LayerError{
+		Index:     index,
+		Digest:    digest,
+		MediaType: mediaType,
+		Error:     msg,
+		Skipped:   skipped,
+		URLs:      urls,
+	})
+}
+
+// deferLayer records a layer skipped by the maximum image size or a download
+// budget, which leaves the scan of the image incomplete.
+func (image *ImageData) deferLayer(index int, digest, mediaType, msg string) {
+	image.LayerErrors = append(image.LayerErrors, LayerError{
+		Index:     index,
+		Digest:    digest,
+		MediaType: mediaType,
+		Error:     msg,
+		Skipped:   true,
+		Deferred:  true,
+	})
+}
+
+// addLayerFailure records a layer that failed while it was processed, along
+// with the limit it exceeded and an integrity finding when it was tampered
+// with.
+func (image *ImageData) addLayerFailure(info *LayerInfo, err error) {
+	image.LayerErrors = append(image.LayerErrors, LayerError{
+		Index:     info.Index,
+		Digest:    info.Digest,
+		MediaType: info.MediaType,
+		Error:     err.Error(),
+		Limit:     limitName(err),
+	})
+	image.addIntegrityFinding(err)
+}
+
+// FailedLayers returns the layers that failed, leaving out skipped layers.
+func (image *ImageData) FailedLayers() []LayerError {
+	var failed []LayerError
+	for _, e := range image.LayerErrors {
+		if !e.Skipped {
+			failed = append(failed, e)
+		}
+	}
+	return failed
+}
+
+// DeferredLayers returns the layers left for a later scan by the maximum image
+// size or a download budget.
+func (image *ImageData) DeferredLayers() []LayerError {
+	var deferred []LayerError
+	for _, e := range image.LayerErrors {
+		if e.Deferred {
+			deferred = append(deferred, e)
+		}
+	}
+	return deferred
+}
+
+// checkLayerMediaType returns an error for layers pilreg cannot process. An
+// empty media type is accepted, the compression is then detected from the
+// content.
+func checkLayerMediaType(mediaType string) error {
+	if mediaType == "" {
+		return nil
+	}
+	if isForeignLayer(mediaType) {
+		return fmt.Errorf("foreign layer with media type %s is not fetched", mediaType)
+	}
+	if _, ok := layerMediaTypes[mediaType]; !ok {
+		return fmt.Errorf("unsupported layer media type %s", mediaType)
+	}
+	return nil
+}
+
+// decompress returns the uncompressed tar stream of a layer blob of the given
+// media type, read with the compression the media type declares. A blob whose
+// magic bytes disagree with its media type is not read and an IntegrityError
+// is returned. Without a known media type the compression is detected from
+// the magic bytes.
+func decompress(r io.Reader, digest, mediaType string) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("peek error: %w", err)
+	}
+	detected := CompressionNone
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		detected = CompressionGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		detected = CompressionZstd
+	}
+	compression := mediaTypeCompression(mediaType)
+	if compression == "" {
+		compression = detected
+	} else if compression != detected {
+		return nil, "", &IntegrityError{Kind: IntegrityMediaType, Digest: digest, Want: mediaType, Got: detected}
+	}
+
+	switch compression {
+	case CompressionGzip:
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", fmt.Errorf("gzip decompress failed: %w", err)
+		}
+		return gzr, CompressionGzip, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderMaxWindow(zstdMaxWindow), zstd.WithDecoderMaxMemory(zstdMaxMemory))
+		if err != nil {
+			return nil, "", fmt.Errorf("zstd decompress failed: %w", err)
+		}
+		return zr.IOReadCloser(), CompressionZstd, nil
+	}
+	return io.NopCloser(br), CompressionNone, nil
+}
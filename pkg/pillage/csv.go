@@ -0,0 +1,192 @@
+package pillage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Names of the CSV files written by the CSV exporter.
+const (
+	ImagesCSV   = "images.csv"
+	FindingsCSV = "findings.csv"
+)
+
+// ImageColumns are the columns available in images.csv, in default order.
+var ImageColumns = []string{"registry", "repo", "tag", "digest", "created", "size", "layers", "platform", "error"}
+
+// FindingColumns are the columns available in findings.csv, in default order.
+var FindingColumns = []string{"severity", "type", "source", "image", "path", "layer", "description", "secret"}
+
+// imageColumn returns the value of a column of images.csv for the record.
+func imageColumn(rec *ImageRecord, column string) string {
+	switch column {
+	case "reference":
+		return rec.Reference
+	case "registry":
+		return rec.Registry
+	case "repo":
+		return rec.Repository
+	case "tag":
+		return rec.Tag
+	case "digest":
+		return rec.Digest
+	case "platform":
+		return rec.Platform
+	case "error":
+		return rec.Error
+	case "created":
+		if cfg, err := v1.ParseConfigFile(bytes.NewReader(rec.Config)); err == nil && !cfg.Created.IsZero() {
+			return cfg.Created.UTC().Format(time.RFC3339)
+		}
+	case "size", "layers":
+		var manifest Manifest
+		if err := json.Unmarshal(rec.Manifest, &manifest); err != nil {
+			return ""
+		}
+		if column == "layers" {
+			return strconv.Itoa(len(manifest.Layers))
+		}
+		var size int64
+		for _, l := range manifest.Layers {
+			size += l.Size
+		}
+		return strconv.FormatInt(size, 10)
+	}
+	return ""
+}
+
+// findingColumn returns the value of a column of findings.csv for the finding.
+func findingColumn(f *Finding, column string) string {
+	switch column {
+	case "severity":
+		return f.Severity
+	case "type":
+		return f.Type
+	case "source":
+		return f.Source
+	case "image":
+		return f.Image
+	case "path":
+		return f.Path
+	case "layer":
+		return f.Layer
+	case "description":
+		return f.Description
+	case "secret":
+		return f.Secret
+	}
+	return ""
+}
+
+// CSVWriter writes the image inventory and findings as images.csv and
+// findings.csv. It is safe for concurrent use, and rows are flushed as they
+// are written so the files are usable while a scan is still running.
+type CSVWriter struct {
+	mu             sync.Mutex
+	imageColumns   []string
+	findingColumns []string
+	imagesFile     *os.File
+	findingsFile   *os.File
+	images         *csv.Writer
+	findings       *csv.Writer
+}
+
+// NewCSVWriter creates images.csv and findings.csv in dir with the selected
+// columns. Empty column lists select all columns.
+func NewCSVWriter(dir string, imageColumns, findingColumns []string) (*CSVWriter, error) {
+	if len(imageColumns) == 0 {
+		imageColumns = ImageColumns
+	}
+	if len(findingColumns) == 0 {
+		findingColumns = FindingColumns
+	}
+	if err := checkColumns(imageColumns, append([]string{"reference"}, ImageColumns...)); err != nil {
+		return nil, err
+	}
+	if err := checkColumns(findingColumns, FindingColumns); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &CSVWriter{imageColumns: imageColumns, findingColumns: findingColumns}
+	var err error
+	if w.imagesFile, err = os.Create(filepath.Join(dir, ImagesCSV)); err != nil {
+		return nil, err
+	}
+	if w.findingsFile, err = os.Create(filepath.Join(dir, FindingsCSV)); err != nil {
+		w.imagesFile.Close()
+		return nil, err
+	}
+	w.images = csv.NewWriter(w.imagesFile)
+	w.findings = csv.NewWriter(w.findingsFile)
+	w.images.Write(imageColumns)
+	w.findings.Write(findingColumns)
+	w.images.Flush()
+	w.findings.Flush()
+	return w, nil
+}
+
+func checkColumns(columns, valid []string) error {
+	for _, c := range columns {
+		found := false
+		for _, v := range valid {
+			if c == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown CSV column %q (valid columns: %v)", c, valid)
+		}
+	}
+	return nil
+}
+
+// Write adds a row for the image to images.csv and one row per finding to
+// findings.csv.
+func (w *CSVWriter) Write(rec *ImageRecord, findings []Finding) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	row := make([]string, len(w.imageColumns))
+	for i, c := range w.imageColumns {
+		row[i] = imageColumn(rec, c)
+	}
+	w.images.Write(row)
+	w.images.Flush()
+	if err := w.images.Error(); err != nil {
+		return err
+	}
+
+	for i := range findings {
+		row := make([]string, len(w.findingColumns))
+		for j, c := range w.findingColumns {
+			row[j] = findingColumn(&findings[i], c)
+		}
+		w.findings.Write(row)
+	}
+	w.findings.Flush()
+	return w.findings.Error()
+}
+
+// Close closes both CSV files.
+func (w *CSVWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.imagesFile.Close()
+	if ferr := w.findingsFile.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+package pillage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// maxDiffInput is the largest version read into memory to be diffed, whatever
+// the file size limit of the layers allows. Larger versions are reported as
+// different without a diff.
+const maxDiffInput = 8 << 20
+
+// maxDiffCells bounds the size of the LCS table. Larger inputs are diffed as a
+// full replacement instead.
+const maxDiffCells = 16 << 20
+
+type diffLine struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// unifiedDiff returns a unified diff turning a into b. Binary content is
+// reported without a diff.
+func unifiedDiff(aName, bName string, a, b []byte) string {
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s and %s differ\n", aName, bName)
+	}
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+
+	// Line numbers in a and b before each diff line.
+	aLine := make([]int, len(lines)+1)
+	bLine := make([]int, len(lines)+1)
+	for i, l := range lines {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if l.kind != '+' {
+			aLine[i+1]++
+		}
+		if l.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(lines); {
+		if lines[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk over changes separated by at most 2*diffContext
+		// unchanged lines.
+		end := i
+		for end < len(lines) {
+			if lines[end].kind != ' ' {
+				end++
+				continue
+			}
+			k := end
+			for k < len(lines) && lines[k].kind == ' ' {
+				k++
+			}
+			if k == len(lines) || k-end > 2*diffContext {
+				end += diffContext
+				if end > len(lines) {
+					end = len(lines)
+				}
+				break
+			}
+			end = k
+		}
+
+		aCount, bCount := aLine[end]-aLine[start], bLine[end]-bLine[start]
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLine[start], aCount), hunkRange(bLine[start], bCount))
+		for _, l := range lines[start:end] {
+			out.WriteByte(l.kind)
+			out.WriteString(l.text)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// diffContent returns the unified diff of two versions of sizes aSize and
+// bSize, reading them into memory only when both are at most maxDiffInput.
+func diffContent(aName, bName string, a io.ReaderAt, aSize int64, b io.ReaderAt, bSize int64) (string, error) {
+	if aSize > maxDiffInput || bSize > maxDiffInput {
+		return fmt.Sprintf("Files %s and %s differ, too large to diff\n", aName, bName), nil
+	}
+	old, err := io.ReadAll(io.NewSectionReader(a, 0, aSize))
+	if err != nil {
+		return "", err
+	}
+	cur, err := io.ReadAll(io.NewSectionReader(b, 0, bSize))
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(aName, bName, old, cur), nil
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// diffLines computes a line based edit script from a to b using the longest
+// common subsequence.
+func diffLines(a, b []string) []diffLine {
+	var lines []diffLine
+	n, m := len(a), len(b)
+	if (n+1)*(m+1) > maxDiffCells {
+		for _, l := range a {
+			lines = append(lines, diffLine{'-', l})
+		}
+		for _, l := range b {
+			lines = append(lines, diffLine{'+', l})
+		}
+		return lines
+	}
+
+	// lcs[i*(m+1)+j] is the length of the LCS of a[i:] and b[j:].
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			} else if x, y := lcs[(i+1)*(m+1)+j], lcs[i*(m+1)+j+1]; x >= y {
+				lcs[i*(m+1)+j] = x
+			} else {
+				lcs[i*(m+1)+j] = y
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+	return lines
+}
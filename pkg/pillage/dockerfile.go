@@ -0,0 +1,254 @@
+package pillage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// DockerfileName is the approximate Dockerfile reconstructed from the image
+// history and written to the image's results directory.
+const DockerfileName = "Dockerfile.reconstructed"
+
+// Labels and annotations naming the base image of an image.
+const (
+	baseNameLabel   = "org.opencontainers.image.base.name"
+	baseDigestLabel = "org.opencontainers.image.base.digest"
+)
+
+// buildkitMarker ends the created_by of history entries written by BuildKit.
+const buildkitMarker = "# buildkit"
+
+var (
+	// nopPrefix starts the created_by of metadata steps and ADD/COPY of the
+	// legacy builder.
+	nopPrefix = regexp.MustCompile(`^/bin/sh -c #\(nop\)\s*`)
+	// legacyCopy is an ADD or COPY of the legacy builder, e.g.
+	// "COPY file:8d1f… in /app ".
+	legacyCopy = regexp.MustCompile(`^(ADD|COPY) (\S+) in (.*)$`)
+	// rootfsAdd is the step of a base image adding its root filesystem, e.g.
+	// "/bin/sh -c #(nop) ADD file:4b03… in / ".
+	rootfsAdd = regexp.MustCompile(`ADD file:\S+ in / *$`)
+	// exposeMap is EXPOSE as recorded by BuildKit, e.g. "map[80/tcp:{}]".
+	exposeMap = regexp.MustCompile(`(\d+/\w+):\{\}`)
+)
+
+// BaseImage names the image an image was built from and how many of its
+// layers come from it.
+type BaseImage struct {
+	Reference string
+	Layers    int
+	History   int    // history entries of the base image, 0 if unknown
+	Source    string // how the base image was detected
+}
+
+// dockerInstruction translates a history created_by into a Dockerfile
+// instruction. Build arguments that leaked into RUN commands are returned as
+// ARG instructions, and buildkit reports the BuildKit marker.
+func dockerInstruction(createdBy string) (inst string, args []string, buildkit bool) {
+	cmd := strings.TrimSpace(createdBy)
+	if rest, ok := strings.CutSuffix(cmd, buildkitMarker); ok {
+		cmd, buildkit = strings.TrimSpace(rest), true
+	}
+	if cmd == "" {
+		return "", nil, buildkit
+	}
+	if loc := nopPrefix.FindStringIndex(cmd); loc != nil {
+		cmd = strings.TrimSpace(cmd[loc[1]:])
+		if m := legacyCopy.FindStringSubmatch(cmd); m != nil {
+			return m[1] + " " + m[2] + " " + strings.TrimSpace(m[3]), nil, buildkit
+		}
+		return expose(cmd), nil, buildkit
+	}
+
+	// BuildKit prefixes RUN steps with the instruction, the legacy builder
+	// does not. Both record the build arguments in use.
+	run := strings.TrimPrefix(cmd, "RUN ")
+	args, run, _ = splitBuildArgs(run)
+	if sh, ok := strings.CutPrefix(run, "/bin/sh -c "); ok {
+		return "RUN " + sh, args, buildkit
+	}
+	if run != cmd || args != nil {
+		return "RUN " + run, args, buildkit
+	}
+
+	word, _, _ := strings.Cut(cmd, " ")
+	switch strings.ToUpper(word) {
+	case "ADD", "COPY", "ARG", "CMD", "ENTRYPOINT", "ENV", "EXPOSE", "HEALTHCHECK", "LABEL", "MAINTAINER",
+		"ONBUILD", "SHELL", "STOPSIGNAL", "USER", "VOLUME", "WORKDIR":
+		return expose(cmd), nil, buildkit
+	}
+	// Steps of other builders, such as "apk add git" without a shell prefix.
+	return "RUN " + cmd, nil, buildkit
+}
+
+// expose rewrites EXPOSE as BuildKit records it to Dockerfile syntax.
+func expose(inst string) string {
+	if !strings.HasPrefix(inst, "EXPOSE map[") {
+		return inst
+	}
+	var ports []string
+	for _, m := range exposeMap.FindAllStringSubmatch(inst, -1) {
+		ports = append(ports, m[1])
+	}
+	return "EXPOSE " + strings.Join(ports, " ")
+}
+
+// detectBase returns the base image named by the labels of the config, or
+// recorded in db as the scanned image with the most layers in common with the
+// image, which must all come first. The layers of a base image named by its
+// label are only known when db has it.
+func (image *ImageData) detectBase(db *ScanDB) *BaseImage {
+	var base *BaseImage
+	var m Manifest
+	if db != nil && json.Unmarshal([]byte(image.Manifest), &m) == nil {
+		layers := make([]string, len(m.Layers))
+		for i, l := range m.Layers {
+			layers[i] = l.Digest
+		}
+		var err error
+		if base, err = db.BaseImage(layers); err != nil {
+			LogDebug("Unable to look up the base image of %s: %v", image.Reference, err)
+		}
+	}
+	cfg, err := v1.ParseConfigFile(strings.NewReader(image.Config))
+	if err == nil && cfg.Config.Labels[baseNameLabel] != "" {
+		ref := cfg.Config.Labels[baseNameLabel]
+		if d := cfg.Config.Labels[baseDigestLabel]; d != "" && !strings.Contains(ref, "@") {
+			ref += "@" + d
+		}
+		label := &BaseImage{Reference: ref, Source: "label " + baseNameLabel}
+		if base != nil {
+			label.Layers, label.History = base.Layers, base.History
+		}
+		return label
+	}
+	return base
+}
+
+// ReconstructDockerfile returns an approximate Dockerfile for the image from
+// the history of its config. Steps of the base image, when known, are
+// replaced by FROM. Build arguments that leaked into the history are written
+// as ARG instructions before the step that used them.
+func (image *ImageData) ReconstructDockerfile(base *BaseImage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Reconstructed by pilreg from the history of %s\n", image.Reference)
+	if image.Digest != "" {
+		fmt.Fprintf(&b, "# Manifest digest %s\n", image.Digest)
+	}
+	b.WriteString("# Steps are approximate: ADD and COPY sources are content hashes, and shell steps lose their\n# line breaks. Lines marked # buildkit were built with BuildKit.\n\n")
+
+	cfg, _ := v1.ParseConfigFile(strings.NewReader(image.Config))
+	history := AttributeLayers(image.Manifest, image.Config)
+	skip, skipHistory := 0, 0
+	switch {
+	case base != nil:
+		fmt.Fprintf(&b, "# Base image detected from %s\nFROM %s\n", base.Source, base.Reference)
+		if base.Layers == 0 {
+			b.WriteString("# The layers of the base image are unknown, its steps are included below\n")
+		}
+		skip, skipHistory = base.Layers, base.History
+	case len(history) > 0 && rootfsAdd.MatchString(history[0].CreatedBy):
+		b.WriteString("# Base image built from scratch, its root filesystem is added by layer 1\nFROM scratch\n")
+	default:
+		b.WriteString("# Unknown base image\nFROM scratch\n")
+	}
+
+	seenArgs := map[string]bool{}
+	emitted, entry := 0, 0
+	for _, layer := range history {
+		if layer.Index <= skip {
+			entry += len(layer.Commands)
+			continue
+		}
+		b.WriteString("\n")
+		if layer.Missing {
+			fmt.Fprintf(&b, "# Layer %d (%s) has no history\n", layer.Index, layer.Digest)
+			continue
+		}
+		fmt.Fprintf(&b, "# Layer %d (%s)\n", layer.Index, layer.Digest)
+		for _, createdBy := range layer.Commands {
+			// Metadata steps of the base image after its last layer.
+			if entry++; entry <= skipHistory {
+				continue
+			}
+			inst, args, buildkit := dockerInstruction(createdBy)
+			if inst == "" {
+				continue
+			}
+			for _, arg := range args {
+				name, _, _ := strings.Cut(arg, "=")
+				if !seenArgs[name] {
+					seenArgs[name] = true
+					fmt.Fprintf(&b, "# Build argument leaked into the history\nARG %s\n", arg)
+				}
+			}
+			if buildkit {
+				b.WriteString(buildkitMarker + "\n")
+			}
+			b.WriteString(inst + "\n")
+			emitted++
+		}
+	}
+
+	if emitted == 0 && cfg != nil {
+		writeConfigInstructions(&b, cfg.Config)
+	}
+	return b.String()
+}
+
+// writeConfigInstructions writes the runtime settings of an image without
+// history.
+func writeConfigInstructions(b *strings.Builder, c v1.Config) {
+	b.WriteString("\n# No build history, settings taken from the image config\n")
+	for _, env := range c.Env {
+		fmt.Fprintf(b, "ENV %s\n", env)
+	}
+	if c.WorkingDir != "" {
+		fmt.Fprintf(b, "WORKDIR %s\n", c.WorkingDir)
+	}
+	if c.User != "" {
+		fmt.Fprintf(b, "USER %s\n", c.User)
+	}
+	ports := make([]string, 0, len(c.ExposedPorts))
+	for port := range c.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	if len(ports) > 0 {
+		fmt.Fprintf(b, "EXPOSE %s\n", strings.Join(ports, " "))
+	}
+	if len(c.Entrypoint) > 0 {
+		fmt.Fprintf(b, "ENTRYPOINT %s\n", execForm(c.Entrypoint))
+	}
+	if len(c.Cmd) > 0 {
+		fmt.Fprintf(b, "CMD %s\n", execForm(c.Cmd))
+	}
+}
+
+func execForm(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = strconv.Quote(a)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// writeDockerfile writes the reconstructed Dockerfile of the image to dir.
+func (image *ImageData) writeDockerfile(dir string) error {
+	if image.Config == "" {
+		return nil
+	}
+	base := image.base
+	if base == nil {
+		base = image.detectBase(nil)
+	}
+	return os.WriteFile(filepath.Join(dir, DockerfileName), []byte(image.ReconstructDockerfile(base)), 0644)
+}
@@ -0,0 +1,302 @@
+package pillage
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RootFSDir is the directory holding the flattened filesystem of an image.
+const RootFSDir = "rootfs"
+
+// ImageFSDir returns where --store-images writes the extracted layers and the
+// flattened rootfs of an image.
+func ImageFSDir(outputPath string, image *ImageData) string {
+	return filepath.Join(outputPath, "images", securejoin(image.Registry, image.Repository, image.Tag))
+}
+
+// layerDirName returns the directory name used for a layer digest.
+func layerDirName(digest string) string {
+	return strings.ReplaceAll(digest, ":", "_")
+}
+
+// fsWriter extracts the entries of a layer into its own directory and applies
+// them, whiteouts included, to the image's flattened rootfs.
+//
+// Extraction never writes through a symlink or outside of the target
+// directory, and device nodes and FIFOs are written as placeholder files so no
+// privileges are needed.
+type fsWriter struct {
+	layerDir string
+	rootfs   string
+	written  map[string]bool // rootfs paths written by this layer
+}
+
+func newFSWriter(layerDir, rootfs string) (*fsWriter, error) {
+	for _, dir := range []string{layerDir, rootfs} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &fsWriter{layerDir: layerDir, rootfs: rootfs, written: map[string]bool{}}, nil
+}
+
+// safePath resolves name inside root, refusing names that leave root or whose
+// parent directories are symlinks.
+func safePath(root, name string) (string, error) {
+	rel := sanitizeName(name)
+	if rel == "" {
+		return "", fmt.Errorf("empty path")
+	}
+	dir := root
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s traverses symlink %s", name, dir)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s: parent %s is not a directory", name, dir)
+		}
+	}
+	return filepath.Join(root, filepath.FromSlash(rel)), nil
+}
+
+// fsAnalyzer extracts every layer and the flattened rootfs for
+// --store-images.
+type fsAnalyzer struct {
+	BaseAnalyzer
+	layer *fsWriter
+}
+
+func (a *fsAnalyzer) OnEntry(layer *LayerInfo, hdr *tar.Header, r io.Reader) error {
+	if a.layer == nil {
+		w, err := newFSWriter(layer.Dir, filepath.Join(filepath.Dir(layer.Dir), RootFSDir))
+		if err != nil {
+			return fmt.Errorf("failed to create layer dir: %w", err)
+		}
+		a.layer = w
+	}
+	a.layer.entry(hdr, r)
+	return nil
+}
+
+func (a *fsAnalyzer) OnLayerEnd(*LayerInfo) error {
+	a.layer = nil
+	return nil
+}
+
+// entry extracts a tar entry into the layer directory and applies it to the
+// rootfs.
+func (f *fsWriter) entry(hdr *tar.Header, r io.Reader) {
+	layerPath, err := f.extract(f.layerDir, hdr, r)
+	if err != nil {
+		LogDebug("Skipping extraction of %s: %v", hdr.Name, err)
+		return
+	}
+
+	name := normalizeEntryPath(hdr.Name)
+	if isWhiteout(name) {
+		f.whiteout(name)
+		return
+	}
+	if err := f.applyToRootFS(hdr, layerPath); err != nil {
+		LogDebug("Skipping %s in rootfs: %v", hdr.Name, err)
+	}
+	for p := name; p != "." && p != "/" && !f.written[p]; p = path.Dir(p) {
+		f.written[p] = true
+	}
+}
+
+// extract writes the entry below root and returns where it was written.
+func (f *fsWriter) extract(root string, hdr *tar.Header, r io.Reader) (string, error) {
+	target, err := safePath(root, hdr.Name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		os.RemoveAll(target)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			os.Remove(target)
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return "", err
+		}
+		os.Chmod(target, os.FileMode(hdr.Mode).Perm()|0700)
+		return target, nil
+	case tar.TypeReg:
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			out.Close()
+			return "", err
+		}
+		if err := out.Close(); err != nil {
+			return "", err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return "", err
+		}
+		return target, nil
+	case tar.TypeLink:
+		source, err := safePath(root, hdr.Linkname)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Lstat(source)
+		if err != nil && root != f.rootfs {
+			// Links to a file of a lower layer resolve through the rootfs.
+			if source, err = safePath(f.rootfs, hdr.Linkname); err != nil {
+				return "", err
+			}
+			info, err = os.Lstat(source)
+		}
+		if err != nil {
+			return "", fmt.Errorf("hardlink to %s: %w", hdr.Linkname, err)
+		}
+		// A link to an extracted symlink would be followed when copied.
+		if !info.Mode().IsRegular() {
+			return "", fmt.Errorf("hardlink to %s: not a regular file", hdr.Linkname)
+		}
+		if err := os.Link(source, target); err != nil {
+			if err := copyFile(source, target); err != nil {
+				return "", fmt.Errorf("hardlink to %s: %w", hdr.Linkname, err)
+			}
+		}
+		return target, nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := os.WriteFile(target, []byte(describeSpecial(hdr)), 0644); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+	applyHeader(target, hdr)
+	return target, nil
+}
+
+// applyToRootFS copies an extracted entry from the layer directory into the
+// rootfs, hardlinking regular files to avoid a second copy.
+func (f *fsWriter) applyToRootFS(hdr *tar.Header, layerPath string) error {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		target, err := safePath(f.rootfs, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		os.RemoveAll(target)
+		if err := os.Link(layerPath, target); err != nil {
+			return copyFile(layerPath, target)
+		}
+		return nil
+	default:
+		_, err := f.extract(f.rootfs, hdr, strings.NewReader(""))
+		return err
+	}
+}
+
+// whiteout applies a whiteout or opaque marker to the rootfs.
+func (f *fsWriter) whiteout(name string) {
+	dir, base := path.Dir(name), path.Base(name)
+	if dir == "." {
+		dir = ""
+	}
+	if base == whiteoutOpaque {
+		target := f.rootfs
+		if dir != "" {
+			var err error
+			if target, err = safePath(f.rootfs, dir); err != nil {
+				LogDebug("Skipping opaque marker %s: %v", name, err)
+				return
+			}
+		}
+		f.clearLower(target, dir)
+		return
+	}
+	target, err := safePath(f.rootfs, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+	if err != nil {
+		LogDebug("Skipping whiteout %s: %v", name, err)
+		return
+	}
+	os.RemoveAll(target)
+}
+
+// clearLower removes everything below dir that was not written by the current
+// layer.
+func (f *fsWriter) clearLower(dir, name string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		child := path.Join(name, e.Name())
+		childPath := filepath.Join(dir, e.Name())
+		if !f.written[child] {
+			os.RemoveAll(childPath)
+			continue
+		}
+		if e.IsDir() {
+			f.clearLower(childPath, child)
+		}
+	}
+}
+
+func describeSpecial(hdr *tar.Header) string {
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		return fmt.Sprintf("character device %d:%d\n", hdr.Devmajor, hdr.Devminor)
+	case tar.TypeBlock:
+		return fmt.Sprintf("block device %d:%d\n", hdr.Devmajor, hdr.Devminor)
+	}
+	return "fifo\n"
+}
+
+// copyFile copies the regular file src to dst, refusing anything else so a
+// symlink is never followed.
+func copyFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
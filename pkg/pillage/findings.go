@@ -0,0 +1,241 @@
+package pillage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Severity levels used for findings, ordered from most to least severe.
+const (
+	SeverityCritical = "critical"
+	SeverityHigh     = "high"
+	SeverityMedium   = "medium"
+	SeverityLow      = "low"
+	SeverityInfo     = "info"
+)
+
+// Finding types.
+const (
+	FindingSecret       = "secret"
+	FindingAudit        = "audit"
+	FindingIntegrity    = "integrity"
+	FindingForeignLayer = "foreign-layer"
+)
+
+// Finding is a single result of an analysis against an image, such as a secret
+// reported by trufflehog or an issue spotted in the image config.
+type Finding struct {
+	Type        string `json:"type"`
+	Severity    string `json:"severity"`
+	Source      string `json:"source"`
+	Image       string `json:"image"`
+	Path        string `json:"path,omitempty"`
+	Layer       string `json:"layer,omitempty"`
+	Description string `json:"description"`
+	Secret      string `json:"secret,omitempty"`
+	// CreatedBy and DeletedBy are the build steps, from the image history,
+	// that added the content to the image and that removed or replaced it.
+	CreatedBy string `json:"createdBy,omitempty"`
+	DeletedBy string `json:"deletedBy,omitempty"`
+}
+
+// SeverityRank returns a sortable rank for a severity, lower is more severe.
+func SeverityRank(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return 0
+	case SeverityHigh:
+		return 1
+	case SeverityMedium:
+		return 2
+	case SeverityLow:
+		return 3
+	case SeverityInfo:
+		return 4
+	}
+	return 5
+}
+
+var secretEnvName = regexp.MustCompile(`(?i)(passw(or)?d|secret|token|api_?key|access_?key|private_?key|credential|auth)`)
+
+// AuditConfig inspects the image config for risky settings such as running as
+// root, secrets passed through environment variables, and build arguments that
+// leaked into the image history.
+func AuditConfig(image *ImageData) []Finding {
+	if image.Config == "" {
+		return nil
+	}
+	cfg, err := v1.ParseConfigFile(strings.NewReader(image.Config))
+	if err != nil {
+		LogDebug("Unable to parse config for audit of %s: %v", image.Reference, err)
+		return nil
+	}
+
+	var findings []Finding
+	if user := cfg.Config.User; user == "" || user == "root" || user == "0" || strings.HasPrefix(user, "0:") {
+		findings = append(findings, Finding{
+			Type:        FindingAudit,
+			Severity:    SeverityLow,
+			Source:      "config",
+			Image:       image.Reference,
+			Description: "Image runs as root",
+		})
+	}
+	for _, env := range cfg.Config.Env {
+		key, value, ok := strings.Cut(env, "=")
+		if !ok || value == "" || !secretEnvName.MatchString(key) {
+			continue
+		}
+		findings = append(findings, Finding{
+			Type:        FindingSecret,
+			Severity:    SeverityHigh,
+			Source:      "config",
+			Image:       image.Reference,
+			Description: fmt.Sprintf("Possible secret in environment variable %s", key),
+			Secret:      value,
+		})
+	}
+	for _, h := range cfg.History {
+		for _, arg := range buildArgs(h.CreatedBy) {
+			key, value, _ := strings.Cut(arg, "=")
+			if value == "" || !secretEnvName.MatchString(key) {
+				continue
+			}
+			findings = append(findings, Finding{
+				Type:        FindingSecret,
+				Severity:    SeverityHigh,
+				Source:      "config",
+				Image:       image.Reference,
+				Description: fmt.Sprintf("Build argument %s leaked into image history", key),
+				Secret:      value,
+			})
+		}
+	}
+	return findings
+}
+
+var buildArgPrefix = regexp.MustCompile(`^\|(\d+) `)
+
+// buildArgs extracts the KEY=value build arguments that Docker records in front
+// of RUN instructions, e.g. "|2 USER=app TOKEN=abc /bin/sh -c make".
+func buildArgs(createdBy string) []string {
+	args, _, _ := splitBuildArgs(strings.TrimPrefix(strings.TrimSpace(createdBy), "RUN "))
+	return args
+}
+
+// splitBuildArgs splits the "|N KEY=value ..." prefix of a RUN command into
+// its N build arguments and the command that follows. ok is false when run
+// has no complete prefix, run is then returned unchanged.
+func splitBuildArgs(run string) (args []string, cmd string, ok bool) {
+	m := buildArgPrefix.FindStringSubmatch(run)
+	if m == nil {
+		return nil, run, false
+	}
+	n, _ := strconv.Atoi(m[1])
+	fields := strings.SplitN(run[len(m[0]):], " ", n+1)
+	if len(fields) != n+1 {
+		return nil, run, false
+	}
+	return fields[:n], fields[n], true
+}
+
+// trufflehogResult is the subset of trufflehog's --json output used by pilreg.
+type trufflehogResult struct {
+	SourceMetadata struct {
+		Data struct {
+			Docker struct {
+				File  string `json:"file"`
+				Layer string `json:"layer"`
+			} `json:"Docker"`
+		} `json:"Data"`
+	} `json:"SourceMetadata"`
+	DetectorName string `json:"DetectorName"`
+	Verified     bool   `json:"Verified"`
+	Raw          string `json:"Raw"`
+}
+
+// parseTruffleHog converts trufflehog JSON lines into findings. Lines that are
+// not JSON results, such as log output, are ignored.
+func parseTruffleHog(image string, output []byte) []Finding {
+	var findings []Finding
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var res trufflehogResult
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil || res.DetectorName == "" {
+			continue
+		}
+		severity := SeverityHigh
+		desc := fmt.Sprintf("%s secret detected", res.DetectorName)
+		if res.Verified {
+			severity = SeverityCritical
+			desc = fmt.Sprintf("Verified %s secret detected", res.DetectorName)
+		}
+		findings = append(findings, Finding{
+			Type:        FindingSecret,
+			Severity:    severity,
+			Source:      "trufflehog",
+			Image:       image,
+			Path:        res.SourceMetadata.Data.Docker.File,
+			Layer:       res.SourceMetadata.Data.Docker.Layer,
+			Description: desc,
+			Secret:      res.Raw,
+		})
+	}
+	return findings
+}
+
+// ResultsDir returns the directory where results for the image are written.
+func ResultsDir(outputPath string, image *ImageData) string {
+	return filepath.Join(outputPath, "results", securejoin(image.Registry, image.Repository, image.Tag))
+}
+
+// Names of the metadata files written to each image results directory.
+const (
+	ImageFile    = "image.json"
+	FindingsFile = "findings.json"
+)
+
+// WriteResults saves the image metadata and its findings into the image's
+// results directory so reports can be generated later without rescanning.
+// Findings are first attributed to the build steps that created and removed
+// their content. The Dockerfile reconstructed from the history is written
+// alongside.
+func (image *ImageData) WriteResults(outputPath string) error {
+	attributeFindings(image, image.layerFiles)
+	dir := ResultsDir(outputPath, image)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create results dir: %w", err)
+	}
+	if err := writeJSON(filepath.Join(dir, ImageFile), NewImageRecord(image)); err != nil {
+		return err
+	}
+	if err := image.writeDockerfile(dir); err != nil {
+		return fmt.Errorf("failed to write %s: %w", DockerfileName, err)
+	}
+	findings := image.Findings
+	if findings == nil {
+		findings = []Finding{}
+	}
+	return writeJSON(filepath.Join(dir, FindingsFile), findings)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package pillage
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// isForeignLayer reports whether layers of the media type are
+// non-distributable: registries usually do not serve them and they are fetched
+// from the URLs of their descriptor instead.
+func isForeignLayer(mediaType string) bool {
+	_, ok := foreignMediaTypes[mediaType]
+	return ok
+}
+
+// foreignLayerFinding records the URLs a non-distributable layer is served
+// from. They often point at vendor storage and reveal where base images come
+// from.
+func foreignLayerFinding(image *ImageData, index int, digest string, urls []string) Finding {
+	desc := fmt.Sprintf("Layer %d is non-distributable and has no URLs", index)
+	if len(urls) > 0 {
+		desc = fmt.Sprintf("Layer %d is non-distributable and served from %s", index, strings.Join(urls, ", "))
+	}
+	return Finding{
+		Type:        FindingForeignLayer,
+		Severity:    SeverityInfo,
+		Source:      "manifest",
+		Image:       image.Reference,
+		Layer:       digest,
+		Description: desc,
+	}
+}
+
+// foreignBlob reads a non-distributable layer from the URLs of its descriptor.
+type foreignBlob struct {
+	digest    v1.Hash
+	size      int64
+	mediaType types.MediaType
+	urls      []string
+	client    *http.Client
+}
+
+// newForeignLayer returns a layer that downloads the blob from urls, trying
+// them in order. Only http and https URLs are used. The content is verified
+// against digest and size like any other blob.
+func newForeignLayer(digest string, size int64, mediaType string, urls []string, opts *StorageOptions) (v1.Layer, error) {
+	h, err := v1.NewHash(digest)
+	if err != nil {
+		return nil, err
+	}
+	var usable []string
+	for _, s := range urls {
+		if u, err := url.Parse(s); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			usable = append(usable, s)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("foreign layer %s has no http or https URLs", digest)
+	}
+	rt := crane.GetOptions(opts.CraneOptions...).Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return partial.CompressedToLayer(&foreignBlob{
+		digest:    h,
+		size:      size,
+		mediaType: types.MediaType(mediaType),
+		urls:      usable,
+		client:    &http.Client{Transport: rt},
+	})
+}
+
+func (b *foreignBlob) Digest() (v1.Hash, error)            { return b.digest, nil }
+func (b *foreignBlob) Size() (int64, error)                { return b.size, nil }
+func (b *foreignBlob) MediaType() (types.MediaType, error) { return b.mediaType, nil }
+
+func (b *foreignBlob) Compressed() (io.ReadCloser, error) {
+	var errs []error
+	for _, u := range b.urls {
+		resp, err := b.client.Get(u)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			errs = append(errs, fmt.Errorf("GET %s: %s", u, resp.Status))
+			continue
+		}
+		LogDebug("Fetching foreign layer %s from %s", b.digest, u)
+		return limitBody(resp.Body, b.size, "foreign layer "+b.digest.String()+" from "+u), nil
+	}
+	return nil, fmt.Errorf("failed to fetch foreign layer %s: %w", b.digest, errors.Join(errs...))
+}
+
+// windowsHivesDir is where the registry hives of a Windows layer are placed
+// once normalized, next to the hives of a running system.
+const windowsHivesDir = "Windows/System32/config"
+
+// normalizeWindowsEntry rewrites an entry of a Windows layer to the path it has
+// in the container. Windows layers keep the filesystem of C:\ below Files/ and
+// the registry hive deltas below Hives/. It reports false for the Files/
+// directory itself, which has no counterpart in the container.
+func normalizeWindowsEntry(hdr *tar.Header) bool {
+	name, ok := windowsPath(hdr.Name)
+	if !ok {
+		return false
+	}
+	hdr.Name = name
+	if hdr.Typeflag == tar.TypeLink {
+		if link, ok := windowsPath(hdr.Linkname); ok {
+			hdr.Linkname = link
+		}
+	}
+	return true
+}
+
+// windowsPath maps a path of a Windows layer to the path in the container.
+// Paths outside Files/ and Hives/, such as UtilityVM/, are kept.
+func windowsPath(p string) (string, bool) {
+	p = strings.TrimPrefix(strings.ReplaceAll(p, `\`, "/"), "./")
+	dir, rest, _ := strings.Cut(p, "/")
+	switch {
+	case strings.EqualFold(dir, "Files"):
+		if strings.Trim(rest, "/") == "" {
+			return "", false
+		}
+		return rest, true
+	case strings.EqualFold(dir, "Hives"):
+		return windowsHivesDir + "/" + rest, true
+	}
+	return p, true
+}
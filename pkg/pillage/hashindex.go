@@ -4,87 +4,274 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
-// HashIndex keeps track of image hashes that have already been scanned.
+// Scan states of an image in the HashIndex.
+const (
+	StateQueued     = "queued"
+	StateInProgress = "in-progress"
+	StateComplete   = "complete"
+	StateFailed     = "failed"
+	// StatePartial is an image whose layers were partly left unread by the
+	// maximum image size or a download budget. It is scanned again like an
+	// interrupted image.
+	StatePartial = "partial"
+)
+
+// ScanRecord is the last known scan state of an image.
+type ScanRecord struct {
+	Hash      string    `json:"hash"`
+	Reference string    `json:"reference,omitempty"`
+	State     string    `json:"state"`
+	Profile   []string  `json:"profile"`
+	Reason    string    `json:"reason,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// HashIndex keeps track of the scan state of images, keyed by manifest hash,
+// along with the analysis profile they were scanned with. State changes are
+// appended to a JSON Lines file so an interrupted run never marks an image as
+// scanned before it actually completed.
 type HashIndex struct {
-	path string
-	mu   sync.Mutex
-	set  map[string]struct{}
+	path    string
+	mu      sync.Mutex
+	records map[string]*ScanRecord
+	claimed map[string]bool
 }
 
-// NewHashIndex loads or creates a hash index at the given path.
+// NewHashIndex loads or creates a hash index at the given path. The file is
+// compacted on load so it only holds the latest state of each image.
 func NewHashIndex(path string) (*HashIndex, error) {
-	hi := &HashIndex{path: path, set: make(map[string]struct{})}
-	// Ensure file exists
+	hi := &HashIndex{path: path, records: make(map[string]*ScanRecord), claimed: make(map[string]bool)}
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0666)
 	if err != nil {
 		return nil, err
 	}
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		hi.set[scanner.Text()] = struct{}{}
+		var rec ScanRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Hash == "" {
+			continue
+		}
+		hi.records[rec.Hash] = &rec
 	}
 	f.Close()
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
+	if err := hi.compact(); err != nil {
+		return nil, err
+	}
 	return hi, nil
 }
 
-// Exists returns true if the hash is already recorded.
-func (h *HashIndex) Exists(hash string) bool {
+// ImportLegacy imports a scanned_shas.log written by older versions, which
+// holds one manifest hash per line. The analyses used for those scans are
+// unknown, so the images are recorded as complete with an empty profile and
+// are scanned again when any analysis is enabled.
+func (h *HashIndex) ImportLegacy(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	_, ok := h.set[hash]
-	return ok
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hash := scanner.Text()
+		if hash == "" {
+			continue
+		}
+		if _, ok := h.records[hash]; ok {
+			continue
+		}
+		if err := h.append(&ScanRecord{Hash: hash, State: StateComplete, Time: time.Now().UTC()}); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
 }
 
-// Add records the given hash if it isn't already stored.
-func (h *HashIndex) Add(hash string) error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	if _, ok := h.set[hash]; ok {
-		return nil
+// compact rewrites the index file with only the latest record of each image.
+func (h *HashIndex) compact() error {
+	hashes := make([]string, 0, len(h.records))
+	for hash := range h.records {
+		hashes = append(hashes, hash)
 	}
-	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY, 0666)
+	sort.Strings(hashes)
+
+	tmp := h.path + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	if _, err := f.WriteString(hash + "\n"); err != nil {
+	enc := json.NewEncoder(f)
+	for _, hash := range hashes {
+		if err := enc.Encode(h.records[hash]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// append records a state change. The caller must hold h.mu.
+func (h *HashIndex) append(rec *ScanRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
 		f.Close()
 		return err
 	}
-	f.Close()
-	h.set[hash] = struct{}{}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	h.records[rec.Hash] = rec
 	return nil
 }
 
-// AddIfMissing checks if the hash exists and records it atomically.
-// It returns true if the hash was already present.
+// Get returns the latest record of the image hash.
+func (h *HashIndex) Get(hash string) (ScanRecord, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rec, ok := h.records[hash]
+	if !ok {
+		return ScanRecord{}, false
+	}
+	return *rec, true
+}
+
+// Exists returns true if the image hash completed a scan.
+func (h *HashIndex) Exists(hash string) bool {
+	rec, ok := h.Get(hash)
+	return ok && rec.State == StateComplete
+}
+
+// Claim decides whether the image should be scanned with the given analysis
+// profile and, if so, records it as queued. Images are scanned when:
+//
+//   - they were never scanned, a previous run was interrupted while scanning
+//     them, or left layers unread because of a size limit or budget,
+//   - they completed with a profile that lacks an analysis that is now enabled,
+//   - they failed and retryFailed is set.
+//
+// With retryFailed only failed, interrupted and partial images are scanned. An image
+// is claimed at most once per run.
+func (h *HashIndex) Claim(hash, reference string, profile []string, retryFailed bool) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.claimed[hash] {
+		return false, nil
+	}
+
+	scan := false
+	rec, ok := h.records[hash]
+	switch {
+	case !ok:
+		scan = !retryFailed
+	case rec.State == StateFailed, rec.State == StateQueued, rec.State == StateInProgress, rec.State == StatePartial:
+		interrupted := rec.State != StateFailed
+		scan = retryFailed || interrupted || !coversProfile(rec.Profile, profile)
+	case rec.State == StateComplete:
+		scan = !retryFailed && !coversProfile(rec.Profile, profile)
+	}
+	if !scan {
+		return false, nil
+	}
+
+	h.claimed[hash] = true
+	return true, h.append(&ScanRecord{
+		Hash:      hash,
+		Reference: reference,
+		State:     StateQueued,
+		Profile:   profile,
+		Time:      time.Now().UTC(),
+	})
+}
+
+// SetState records a state change of a claimed image. reason explains failures.
+func (h *HashIndex) SetState(hash, state, reason string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rec, ok := h.records[hash]
+	if !ok {
+		return fmt.Errorf("image %s was not claimed", hash)
+	}
+	next := *rec
+	next.State = state
+	next.Reason = reason
+	next.Time = time.Now().UTC()
+	return h.append(&next)
+}
+
+// Add records the hash as scanned if it isn't already stored.
+//
+// Deprecated: use Claim and SetState, which also record the analysis profile.
+func (h *HashIndex) Add(hash string) error {
+	_, err := h.AddIfMissing(hash)
+	return err
+}
+
+// AddIfMissing checks if the hash exists and records it as scanned
+// atomically. It returns true if the hash was already present. Like legacy
+// hashes, the image is recorded with an empty profile.
+//
+// Deprecated: use Claim and SetState, which also record the analysis profile.
 func (h *HashIndex) AddIfMissing(hash string) (bool, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	if _, ok := h.set[hash]; ok {
+	if _, ok := h.records[hash]; ok {
 		return true, nil
 	}
-	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return false, err
-	}
-	if _, err := f.WriteString(hash + "\n"); err != nil {
-		f.Close()
-		return false, err
+	return false, h.append(&ScanRecord{Hash: hash, State: StateComplete, Time: time.Now().UTC()})
+}
+
+// coversProfile reports whether every analysis of want is in have.
+func coversProfile(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
 	}
-	f.Close()
-	h.set[hash] = struct{}{}
-	return false, nil
+	return true
 }
 
-// ImageHash returns the SHA256 of the image's manifest.
+// ImageHash returns the SHA256 of the image's manifest. Images whose manifest
+// could not be fetched or lists no layers would all share a hash, so they are
+// keyed by reference instead.
 func ImageHash(img *ImageData) string {
-	sum := sha256.Sum256([]byte(img.Manifest))
+	key := img.Manifest
+	var m Manifest
+	if img.Error != nil || json.Unmarshal([]byte(img.Manifest), &m) != nil || len(m.Layers) == 0 {
+		key = "reference:" + img.Reference
+	}
+	sum := sha256.Sum256([]byte(key))
 	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,185 @@
+package pillage
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// LayerHistory attributes a layer of an image to the build step that created
+// it.
+type LayerHistory struct {
+	Index     int    `json:"index"`
+	Digest    string `json:"digest"`
+	CreatedBy string `json:"createdBy,omitempty"`
+	// Commands lists the history entries of the layer in order: the steps
+	// that did not create a layer, such as ENV, followed by the one that
+	// created it.
+	Commands []string `json:"commands,omitempty"`
+	// Missing is set for layers the history has no entry for.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// Attribution is the history of every layer of an image, in manifest order.
+type Attribution []LayerHistory
+
+// AttributeLayers aligns the history entries of the config that created a
+// layer with the layers of the manifest. History is often partial, e.g. when
+// the base image was squashed or built by a tool that does not record it, so
+// entries are aligned from the last layer and the first layers are left
+// without history. When there are more entries than layers, metadata only
+// steps without the empty_layer flag, as written by old builders, are not
+// counted.
+func AttributeLayers(manifest, config string) Attribution {
+	var m Manifest
+	if err := json.Unmarshal([]byte(manifest), &m); err != nil {
+		return nil
+	}
+	out := make(Attribution, len(m.Layers))
+	for i, l := range m.Layers {
+		out[i] = LayerHistory{Index: i + 1, Digest: l.Digest, Missing: true}
+	}
+	cfg, err := v1.ParseConfigFile(strings.NewReader(config))
+	if err != nil || len(out) == 0 {
+		return out
+	}
+
+	empty := func(h v1.History) bool { return h.EmptyLayer }
+	if countLayers(cfg.History, empty) > len(out) {
+		empty = func(h v1.History) bool { return h.EmptyLayer || metadataOnly(h.CreatedBy) }
+	}
+	layer := len(out) - countLayers(cfg.History, empty)
+	var pending []string
+	for _, h := range cfg.History {
+		pending = append(pending, h.CreatedBy)
+		if empty(h) {
+			continue
+		}
+		target := min(max(layer, 0), len(out)-1)
+		out[target].Commands = append(out[target].Commands, pending...)
+		if layer >= 0 && layer < len(out) {
+			out[layer].CreatedBy, out[layer].Missing = h.CreatedBy, false
+		}
+		pending = nil
+		layer++
+	}
+	last := &out[len(out)-1]
+	last.Commands = append(last.Commands, pending...)
+	return out
+}
+
+func countLayers(history []v1.History, empty func(v1.History) bool) int {
+	n := 0
+	for _, h := range history {
+		if !empty(h) {
+			n++
+		}
+	}
+	return n
+}
+
+// metadataInstructions only change the config, they never create a layer.
+var metadataInstructions = map[string]bool{
+	"ARG": true, "CMD": true, "ENTRYPOINT": true, "ENV": true, "EXPOSE": true, "HEALTHCHECK": true,
+	"LABEL": true, "MAINTAINER": true, "ONBUILD": true, "SHELL": true, "STOPSIGNAL": true,
+	"USER": true, "VOLUME": true, "WORKDIR": true,
+}
+
+// metadataOnly reports whether a created_by command is a step that cannot
+// create a layer.
+func metadataOnly(createdBy string) bool {
+	cmd := strings.TrimSpace(createdBy)
+	if rest, ok := strings.CutPrefix(cmd, "/bin/sh -c #(nop)"); ok {
+		cmd = strings.TrimSpace(rest)
+	}
+	word, _, _ := strings.Cut(cmd, " ")
+	return metadataInstructions[strings.ToUpper(word)]
+}
+
+// Layer returns the history of the layer with the given number, starting at
+// 1, or nil.
+func (a Attribution) Layer(index int) *LayerHistory {
+	if index < 1 || index > len(a) {
+		return nil
+	}
+	return &a[index-1]
+}
+
+// CreatedBy returns the command that created the layer with the given number.
+func (a Attribution) CreatedBy(index int) string {
+	if h := a.Layer(index); h != nil {
+		return h.CreatedBy
+	}
+	return ""
+}
+
+// ByDigest returns the history of the first layer with the digest, or nil.
+func (a Attribution) ByDigest(digest string) *LayerHistory {
+	for i := range a {
+		if a[i].Digest == digest {
+			return &a[i]
+		}
+	}
+	return nil
+}
+
+// deletedIn returns the first layer after index whose files delete or replace
+// the file at p: a whiteout of the file or one of its directories, an opaque
+// directory above it, or a new entry at the same path. files holds the
+// inventory of each layer by number.
+func deletedIn(files map[int][]FileEntry, index, last int, p string) int {
+	p = normalizeEntryPath(p)
+	for l := index + 1; l <= last; l++ {
+		for _, f := range files[l] {
+			if f.Path == p {
+				return l
+			}
+			if !f.Whiteout {
+				continue
+			}
+			dir, base := path.Split(f.Path)
+			if base == whiteoutOpaque {
+				if strings.HasPrefix(p, dir) {
+					return l
+				}
+				continue
+			}
+			hidden := dir + strings.TrimPrefix(base, whiteoutPrefix)
+			if p == hidden || strings.HasPrefix(p, hidden+"/") {
+				return l
+			}
+		}
+	}
+	return 0
+}
+
+// addLayerFiles keeps the inventory of a layer for attributeFindings.
+func (image *ImageData) addLayerFiles(index int, files []FileEntry) {
+	if image.layerFiles == nil {
+		image.layerFiles = map[int][]FileEntry{}
+	}
+	image.layerFiles[index] = files
+}
+
+// attributeFindings sets the commands that created, and deleted or
+// overwrote, the content behind every finding that names a layer. files holds
+// the inventory of the layers that were read.
+func attributeFindings(image *ImageData, files map[int][]FileEntry) {
+	history := AttributeLayers(image.Manifest, image.Config)
+	for i := range image.Findings {
+		f := &image.Findings[i]
+		layer := history.ByDigest(f.Layer)
+		if layer == nil {
+			continue
+		}
+		f.CreatedBy = layer.CreatedBy
+		if f.Path == "" {
+			continue
+		}
+		if deleted := deletedIn(files, layer.Index, len(history), f.Path); deleted > 0 {
+			f.DeletedBy = history.CreatedBy(deleted)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package pillage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Changes between the two images of a diff.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// FileState is a file in one of the images of a diff. Files of the shared
+// layers are known from the layer cache inventory and have no SHA256.
+type FileState struct {
+	SHA256   string `json:"sha256,omitempty"`
+	Size     int64  `json:"size"`
+	Mode     string `json:"mode,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+	Layer    int    `json:"layer,omitempty"` // layer that wrote the file, starting at 1
+}
+
+// FileChange is a file added, removed or modified between two images.
+type FileChange struct {
+	Path   string     `json:"path"`
+	Change string     `json:"change"`
+	From   *FileState `json:"from,omitempty"`
+	To     *FileState `json:"to,omitempty"`
+}
+
+// ConfigChange is a runtime setting of the config that differs between two
+// images. Key names the variable, label or port of map-like fields.
+type ConfigChange struct {
+	Field  string `json:"field"`
+	Key    string `json:"key,omitempty"`
+	Change string `json:"change"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// ImageDiff is what changed from one image to another.
+type ImageDiff struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	FromDigest string `json:"fromDigest,omitempty"`
+	ToDigest   string `json:"toDigest,omitempty"`
+	// SharedLayers are the layers both images start with. They are not read,
+	// only the layers after them are compared.
+	SharedLayers []string       `json:"sharedLayers"`
+	Files        []FileChange   `json:"files"`
+	Config       []ConfigChange `json:"config"`
+	// NewFindings are the findings of the second image the first one does
+	// not have.
+	NewFindings []Finding `json:"newFindings"`
+	// Errors lists the layers that could not be read, the diff is incomplete
+	// when it is not empty.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// DiffImages compares two images, e.g. two tags of a repository. The layers
+// both images start with are skipped by digest; the layers after them are
+// walked once per image and their files are compared by SHA256. Findings of
+// both images come from the same analyzers as a scan, and the config audit.
+// The images are not modified, so they can be compared again.
+func DiffImages(from, to *ImageData, options *StorageOptions) (*ImageDiff, error) {
+	for _, image := range []*ImageData{from, to} {
+		if image.Error != nil {
+			return nil, fmt.Errorf("%s: %w", image.Reference, image.Error)
+		}
+	}
+	from, to = from.scanCopy(), to.scanCopy()
+	fromLayers, err := manifestLayers(from)
+	if err != nil {
+		return nil, err
+	}
+	toLayers, err := manifestLayers(to)
+	if err != nil {
+		return nil, err
+	}
+	d := &ImageDiff{From: from.Reference, To: to.Reference, FromDigest: from.Digest, ToDigest: to.Digest, SharedLayers: []string{}}
+	skip := map[string]bool{}
+	for i := 0; i < len(fromLayers) && i < len(toLayers) && fromLayers[i] == toLayers[i]; i++ {
+		d.SharedLayers = append(d.SharedLayers, fromLayers[i])
+		skip[fromLayers[i]] = true
+	}
+	shared := sharedTree(d.SharedLayers, options.Cache)
+
+	trees := make([]*fileTree, 2)
+	for i, image := range []*ImageData{from, to} {
+		tree := newFileTree()
+		trees[i] = tree
+		opts := *options
+		opts.SkipLayers = skip
+		opts.Analyzers = append(append([]func() Analyzer(nil), options.Analyzers...), func() Analyzer { return tree })
+		if err := image.Store(&opts); err != nil {
+			return nil, fmt.Errorf("%s: %w", image.Reference, err)
+		}
+		for _, le := range image.FailedLayers() {
+			d.Errors = append(d.Errors, fmt.Sprintf("%s layer %d (%s): %s", image.Reference, le.Index, le.Digest, le.Error))
+		}
+		image.Findings = append(image.Findings, AuditConfig(image)...)
+	}
+
+	d.Files = diffTrees(trees[0], trees[1], shared)
+	d.Config = diffConfigs(from.Config, to.Config)
+	d.NewFindings = newFindings(from.Findings, to.Findings)
+	return d, nil
+}
+
+// scanCopy returns a shallow copy of the image whose findings, layer errors,
+// recovered files and layer inventories can be changed by Store without
+// touching the image.
+func (image *ImageData) scanCopy() *ImageData {
+	c := *image
+	c.Findings = append([]Finding(nil), image.Findings...)
+	c.Recovered = append([]RecoveredFile(nil), image.Recovered...)
+	c.LayerErrors = append([]LayerError(nil), image.LayerErrors...)
+	c.layerFiles = nil
+	return &c
+}
+
+func manifestLayers(image *ImageData) ([]string, error) {
+	var m Manifest
+	if err := json.Unmarshal([]byte(image.Manifest), &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest for %s: %w", image.Reference, err)
+	}
+	layers := make([]string, len(m.Layers))
+	for i, l := range m.Layers {
+		layers[i] = l.Digest
+	}
+	return layers, nil
+}
+
+// fileTree is the filesystem an image builds on top of the layers it shares
+// with the other image: the files its own layers write, and the paths they
+// delete from the layers below. Whiteouts of a layer apply to the layers below
+// it, so the entries of a layer are applied once it ends.
+type fileTree struct {
+	BaseAnalyzer
+	files   map[string]*FileState
+	deleted map[string]bool // paths removed by a whiteout
+	opaque  map[string]bool // directories whose content below was hidden
+	known   bool            // the tree is complete, see sharedTree
+
+	pendingFiles   map[string]*FileState
+	pendingDeleted []string
+	pendingOpaque  []string
+}
+
+func newFileTree() *fileTree {
+	return &fileTree{files: map[string]*FileState{}, deleted: map[string]bool{}, opaque: map[string]bool{}, known: true}
+}
+
+func (t *fileTree) OnEntry(layer *LayerInfo, hdr *tar.Header, r io.Reader) error {
+	state := &FileState{Size: hdr.Size, Mode: hdr.FileInfo().Mode().String(), Linkname: hdr.Linkname, Layer: layer.Index}
+	if hdr.Typeflag == tar.TypeReg {
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+		state.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	t.add(hdr.Name, hdr.Typeflag, state)
+	return nil
+}
+
+func (t *fileTree) OnLayerEnd(*LayerInfo) error {
+	t.apply()
+	return nil
+}
+
+// add records an entry of the current layer. Directories are left out, a
+// change to a directory shows as the changes to its files.
+func (t *fileTree) add(name string, typ byte, state *FileState) {
+	p := normalizeEntryPath(name)
+	dir, base := path.Split(p)
+	dir = strings.TrimSuffix(dir, "/")
+	switch {
+	case base == whiteoutOpaque:
+		t.pendingOpaque = append(t.pendingOpaque, dir)
+	case strings.HasPrefix(base, whiteoutPrefix):
+		t.pendingDeleted = append(t.pendingDeleted, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+	case typ != tar.TypeDir && p != "":
+		if t.pendingFiles == nil {
+			t.pendingFiles = map[string]*FileState{}
+		}
+		t.pendingFiles[p] = state
+	}
+}
+
+// apply applies the whiteouts of the current layer, then its files.
+func (t *fileTree) apply() {
+	for _, dir := range t.pendingOpaque {
+		t.removeBelow(dir)
+		t.opaque[dir] = true
+	}
+	for _, p := range t.pendingDeleted {
+		delete(t.files, p)
+		t.removeBelow(p)
+		t.deleted[p] = true
+	}
+	for p, state := range t.pendingFiles {
+		t.files[p] = state
+	}
+	t.pendingFiles, t.pendingDeleted, t.pendingOpaque = nil, nil, nil
+}
+
+func (t *fileTree) removeBelow(dir string) {
+	for p := range t.files {
+		if dir == "" || strings.HasPrefix(p, dir+"/") {
+			delete(t.files, p)
+		}
+	}
+}
+
+// hidden reports whether the tree deletes p from the layers below it.
+func (t *fileTree) hidden(p string) bool {
+	if t.deleted[p] {
+		return true
+	}
+	for dir := p; dir != ""; {
+		if i := strings.LastIndex(dir, "/"); i >= 0 {
+			dir = dir[:i]
+		} else {
+			dir = ""
+		}
+		if t.deleted[dir] || t.opaque[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownFile stands for a file of the shared layers whose inventory is not
+// in the layer cache.
+var unknownFile = &FileState{}
+
+// lookup returns the state of p in the image, or nil when it does not have it.
+// A path the other image deletes is taken to exist in the shared layers when
+// their inventory is not known.
+func (t *fileTree) lookup(p string, shared, other *fileTree) *FileState {
+	if f := t.files[p]; f != nil {
+		return f
+	}
+	if t.hidden(p) {
+		return nil
+	}
+	if f := shared.files[p]; f != nil {
+		return f
+	}
+	if !shared.known && other.deleted[p] {
+		return unknownFile
+	}
+	return nil
+}
+
+// sharedTree builds the files of the shared layers from their inventory in
+// the layer cache, so they are not downloaded. Without the inventory of every
+// shared layer, a file one image replaces is reported as added rather than
+// modified.
+func sharedTree(layers []string, cache *LayerCache) *fileTree {
+	t := newFileTree()
+	for i, digest := range layers {
+		var res *LayerResult
+		if cache != nil {
+			res, _ = cache.LoadResult(digest)
+		}
+		if res == nil {
+			t.known = false
+			continue
+		}
+		for _, f := range res.Files {
+			t.add(f.Path, f.Type, entryState(f, i+1))
+		}
+		t.apply()
+	}
+	return t
+}
+
+// entryState is the state of a file of a layer inventory.
+func entryState(f FileEntry, layer int) *FileState {
+	mode := (&tar.Header{Mode: f.Mode, Typeflag: f.Type}).FileInfo().Mode().String()
+	return &FileState{Size: f.Size, Mode: mode, Linkname: f.Linkname, Layer: layer}
+}
+
+// diffTrees compares the files of two images on top of their shared layers.
+func diffTrees(from, to, shared *fileTree) []FileChange {
+	paths := map[string]bool{}
+	for _, t := range []*fileTree{from, to} {
+		for p := range t.files {
+			paths[p] = true
+		}
+		for p := range t.deleted {
+			paths[p] = true
+		}
+	}
+	for p := range shared.files {
+		if from.hidden(p) || to.hidden(p) {
+			paths[p] = true
+		}
+	}
+
+	changes := []FileChange{}
+	for p := range paths {
+		a, b := from.lookup(p, shared, to), to.lookup(p, shared, from)
+		change := FileChange{Path: "/" + p, From: a, To: b}
+		switch {
+		case a == b:
+			continue
+		case a == nil:
+			change.Change = ChangeAdded
+		case b == nil:
+			change.Change = ChangeRemoved
+		case a.SHA256 == b.SHA256 && a.SHA256 != "" && a.Mode == b.Mode && a.Linkname == b.Linkname:
+			continue
+		case a.SHA256 == "" && b.SHA256 == "" && a.Linkname != "" && a.Linkname == b.Linkname && a.Mode == b.Mode:
+			continue
+		default:
+			change.Change = ChangeModified
+		}
+		if change.From == unknownFile {
+			change.From = nil
+		}
+		if change.To == unknownFile {
+			change.To = nil
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// diffConfigs compares the runtime settings of two image configs.
+func diffConfigs(from, to string) []ConfigChange {
+	var a, b v1.Config
+	if cfg, err := v1.ParseConfigFile(strings.NewReader(from)); err == nil {
+		a = cfg.Config
+	}
+	if cfg, err := v1.ParseConfigFile(strings.NewReader(to)); err == nil {
+		b = cfg.Config
+	}
+	changes := []ConfigChange{}
+	changes = append(changes, diffMaps("env", envMap(a.Env), envMap(b.Env))...)
+	changes = append(changes, diffMaps("label", a.Labels, b.Labels)...)
+	changes = append(changes, diffValue("entrypoint", execForm(a.Entrypoint), execForm(b.Entrypoint))...)
+	changes = append(changes, diffValue("cmd", execForm(a.Cmd), execForm(b.Cmd))...)
+	changes = append(changes, diffValue("user", a.User, b.User)...)
+	changes = append(changes, diffValue("workdir", a.WorkingDir, b.WorkingDir)...)
+	changes = append(changes, diffMaps("exposedPort", portMap(a.ExposedPorts), portMap(b.ExposedPorts))...)
+	return changes
+}
+
+func envMap(env []string) map[string]string {
+	m := map[string]string{}
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func portMap(ports map[string]struct{}) map[string]string {
+	m := map[string]string{}
+	for p := range ports {
+		m[p] = p
+	}
+	return m
+}
+
+func diffValue(field, from, to string) []ConfigChange {
+	if from == to {
+		return nil
+	}
+	change := ConfigChange{Field: field, Change: ChangeModified, From: from, To: to}
+	if from == "" || from == "[]" {
+		change.Change, change.From = ChangeAdded, ""
+	} else if to == "" || to == "[]" {
+		change.Change, change.To = ChangeRemoved, ""
+	}
+	return []ConfigChange{change}
+}
+
+func diffMaps(field string, from, to map[string]string) []ConfigChange {
+	var changes []ConfigChange
+	for k, v := range from {
+		if w, ok := to[k]; !ok {
+			changes = append(changes, ConfigChange{Field: field, Key: k, Change: ChangeRemoved, From: v})
+		} else if v != w {
+			changes = append(changes, ConfigChange{Field: field, Key: k, Change: ChangeModified, From: v, To: w})
+		}
+	}
+	for k, w := range to {
+		if _, ok := from[k]; !ok {
+			changes = append(changes, ConfigChange{Field: field, Key: k, Change: ChangeAdded, To: w})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// findingKey identifies a finding across images: findings are the same when
+// they have the same type, path, description and secret, so a secret moved to
+// another layer is the same finding.
+func findingKey(f Finding) string {
+	return strings.Join([]string{f.Type, f.Path, f.Description, f.Secret}, "\x00")
+}
+
+// newFindings returns the findings of to that from does not have.
+func newFindings(from, to []Finding) []Finding {
+	seen := map[string]bool{}
+	for _, f := range from {
+		seen[findingKey(f)] = true
+	}
+	found := []Finding{}
+	for _, f := range to {
+		if k := findingKey(f); !seen[k] {
+			seen[k] = true
+			found = append(found, f)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return SeverityRank(found[i].Severity) < SeverityRank(found[j].Severity)
+	})
+	return found
+}
+
+// WriteText writes the diff for a terminal, one change per line: A for added,
+// D for removed and M for modified.
+func (d *ImageDiff) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "--- %s %s\n+++ %s %s\n", d.From, d.FromDigest, d.To, d.ToDigest)
+	fmt.Fprintf(tw, "%d shared layers skipped\n", len(d.SharedLayers))
+	for _, e := range d.Errors {
+		fmt.Fprintf(tw, "incomplete: %s\n", e)
+	}
+
+	fmt.Fprintf(tw, "\nFiles (%d):\n", len(d.Files))
+	for _, c := range d.Files {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", changeLetter(c.Change), c.Path, fileStates(c))
+	}
+	fmt.Fprintf(tw, "\nConfig (%d):\n", len(d.Config))
+	for _, c := range d.Config {
+		name := c.Field
+		if c.Key != "" {
+			name += " " + c.Key
+		}
+		value := c.To
+		switch c.Change {
+		case ChangeRemoved:
+			value = c.From
+		case ChangeModified:
+			value = c.From + " -> " + c.To
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", changeLetter(c.Change), name, value)
+	}
+	fmt.Fprintf(tw, "\nNew findings (%d):\n", len(d.NewFindings))
+	for _, f := range d.NewFindings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Severity, f.Type, f.Path, f.Description)
+	}
+	return tw.Flush()
+}
+
+func changeLetter(change string) string {
+	switch change {
+	case ChangeAdded:
+		return "A"
+	case ChangeRemoved:
+		return "D"
+	}
+	return "M"
+}
+
+func fileStates(c FileChange) string {
+	describe := func(s *FileState) string {
+		switch {
+		case s == nil:
+			return "?"
+		case s.Linkname != "":
+			return "-> " + s.Linkname
+		case s.SHA256 != "":
+			return fmt.Sprintf("sha256:%s (%d bytes)", s.SHA256[:min(12, len(s.SHA256))], s.Size)
+		}
+		return fmt.Sprintf("%d bytes", s.Size)
+	}
+	switch c.Change {
+	case ChangeAdded:
+		return describe(c.To)
+	case ChangeRemoved:
+		return describe(c.From)
+	}
+	return describe(c.From) + " => " + describe(c.To)
+}
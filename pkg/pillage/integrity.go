@@ -0,0 +1,148 @@
+package pillage
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Kinds of integrity problems.
+const (
+	IntegrityDigest    = "digest"     // blob does not match its manifest digest
+	IntegritySize      = "size"       // blob does not match its manifest size
+	IntegrityDiffID    = "diff_id"    // uncompressed layer does not match the config
+	IntegrityMissing   = "missing"    // blob referenced by the manifest is not served
+	IntegrityMediaType = "media-type" // blob compression does not match its media type
+)
+
+// IntegrityError reports a blob that does not match the digest or size its
+// manifest or config gives for it, or that the registry does not serve.
+type IntegrityError struct {
+	Kind   string
+	Digest string // digest the blob is referenced by
+	Want   string
+	Got    string
+}
+
+func (e *IntegrityError) Error() string {
+	switch e.Kind {
+	case IntegrityMissing:
+		return fmt.Sprintf("blob %s is referenced by the manifest but missing from the registry", e.Digest)
+	case IntegritySize:
+		return fmt.Sprintf("blob %s has size %s, the manifest says %s", e.Digest, e.Got, e.Want)
+	case IntegrityDiffID:
+		return fmt.Sprintf("layer %s uncompresses to %s, the config's rootfs.diff_ids says %s", e.Digest, e.Got, e.Want)
+	case IntegrityMediaType:
+		return fmt.Sprintf("layer %s is %s compressed, its media type is %s", e.Digest, e.Got, e.Want)
+	}
+	return fmt.Sprintf("blob %s has digest %s", e.Digest, e.Got)
+}
+
+// Finding returns the finding recorded for the integrity problem. Content
+// that does not match its digests means the registry or something between it
+// and pilreg altered it, so those findings are critical. A missing blob or a
+// wrong media type is more likely a broken push.
+func (e *IntegrityError) Finding(image *ImageData) Finding {
+	severity := SeverityCritical
+	if e.Kind == IntegrityMissing || e.Kind == IntegrityMediaType {
+		severity = SeverityMedium
+	}
+	return Finding{
+		Type:        FindingIntegrity,
+		Severity:    severity,
+		Source:      "registry",
+		Image:       image.Reference,
+		Layer:       e.Digest,
+		Description: e.Error(),
+	}
+}
+
+// addIntegrityFinding records err as a finding of the image when it is an
+// integrity problem and reports whether it was one.
+func (image *ImageData) addIntegrityFinding(err error) bool {
+	var ierr *IntegrityError
+	if !errors.As(err, &ierr) {
+		return false
+	}
+	LogWarn("Integrity problem in %s: %v", image.Reference, ierr)
+	image.Findings = append(image.Findings, ierr.Finding(image))
+	return true
+}
+
+// blobError classifies an error returned while fetching the blob digest.
+// Blobs the registry does not serve are returned as an IntegrityError, other
+// errors are returned unchanged. Content that does not match its digest or
+// size is detected by comparing them, see verifyBlob and checkBlob.
+func blobError(digest string, err error) error {
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return &IntegrityError{Kind: IntegrityMissing, Digest: digest}
+	}
+	return err
+}
+
+// verifyBlob checks a downloaded blob against the digest and size of the
+// layer's descriptor.
+func verifyBlob(layer v1.Layer, got string, size int64) error {
+	want, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	wantSize, err := layer.Size()
+	if err != nil {
+		wantSize = size
+	}
+	return compareBlob(want.String(), wantSize, got, size)
+}
+
+// compareBlob returns an IntegrityError when a blob of digest got and size
+// bytes is not the blob of digest want and wantSize bytes.
+func compareBlob(want string, wantSize int64, got string, size int64) error {
+	if wantSize != size {
+		return &IntegrityError{Kind: IntegritySize, Digest: want, Want: fmt.Sprint(wantSize), Got: fmt.Sprint(size)}
+	}
+	if got != want {
+		return &IntegrityError{Kind: IntegrityDigest, Digest: want, Want: want, Got: got}
+	}
+	return nil
+}
+
+// checkBlob reads a blob and compares it with its descriptor. A body cut off
+// by limitBody past the declared size is reported as a size mismatch.
+func checkBlob(r io.Reader, desc v1.Descriptor) error {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if errors.Is(err, errTooLarge) {
+		return &IntegrityError{Kind: IntegritySize, Digest: desc.Digest.String(), Want: fmt.Sprint(desc.Size), Got: fmt.Sprintf("more than %d", desc.Size)}
+	}
+	if err != nil {
+		return err
+	}
+	return compareBlob(desc.Digest.String(), desc.Size, fmt.Sprintf("sha256:%x", h.Sum(nil)), size)
+}
+
+// configError classifies an error returned while fetching the config blob
+// desc of the image ref. The registry client rejects a config that does not
+// match its descriptor, so the config is read again without it and compared
+// here; an error that is not an integrity problem is returned unchanged.
+func configError(ref string, desc v1.Descriptor, err error, options []crane.Option) error {
+	if berr := blobError(desc.Digest.String(), err); berr != err {
+		return berr
+	}
+	rc, rerr := registryRange(ref, desc.Digest.String(), desc.Size, &StorageOptions{CraneOptions: options})(0)
+	if rerr != nil {
+		return err
+	}
+	defer rc.Close()
+	var ierr *IntegrityError
+	if cerr := checkBlob(rc, desc); errors.As(cerr, &ierr) {
+		return ierr
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package pillage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ImageRecord is the JSON representation of an enumerated image. It is used for
+// the --jsonl output stream where each image is written on its own line.
+type ImageRecord struct {
+	Reference   string          `json:"reference"`
+	Registry    string          `json:"registry,omitempty"`
+	Repository  string          `json:"repository,omitempty"`
+	Tag         string          `json:"tag,omitempty"`
+	Digest      string          `json:"digest,omitempty"`
+	Platform    string          `json:"platform,omitempty"`
+	Manifest    json.RawMessage `json:"manifest,omitempty"`
+	Config      json.RawMessage `json:"config,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	LayerErrors []LayerError    `json:"layerErrors,omitempty"`
+}
+
+// NewImageRecord builds an ImageRecord from the enumerated image. Manifest and
+// config are embedded as parsed JSON when they are valid, so tools like jq can
+// query into them directly.
+func NewImageRecord(image *ImageData) *ImageRecord {
+	rec := &ImageRecord{
+		Reference:   image.Reference,
+		Registry:    image.Registry,
+		Repository:  image.Repository,
+		Tag:         image.Tag,
+		Digest:      image.Digest,
+		Manifest:    rawJSON(image.Manifest),
+		Config:      rawJSON(image.Config),
+		LayerErrors: image.LayerErrors,
+	}
+	if image.Error != nil {
+		rec.Error = image.Error.Error()
+	}
+	if image.Config != "" {
+		if cfg, err := v1.ParseConfigFile(bytes.NewReader([]byte(image.Config))); err == nil {
+			rec.Platform = PlatformString(cfg)
+		}
+	}
+	return rec
+}
+
+// PlatformString returns the os/arch[/variant] string for an image config.
+func PlatformString(cfg *v1.ConfigFile) string {
+	if cfg == nil || cfg.OS == "" {
+		return ""
+	}
+	p := cfg.OS + "/" + cfg.Architecture
+	if cfg.Variant != "" {
+		p += "/" + cfg.Variant
+	}
+	return p
+}
+
+func rawJSON(s string) json.RawMessage {
+	if s == "" || !json.Valid([]byte(s)) {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+// JSONLWriter writes one ImageRecord per line. It is safe for concurrent use.
+type JSONLWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLWriter returns a JSONLWriter writing to w.
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	return &JSONLWriter{enc: json.NewEncoder(w)}
+}
+
+// Write encodes the image as a single JSON line.
+func (w *JSONLWriter) Write(image *ImageData) error {
+	rec := NewImageRecord(image)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(rec)
+}
@@ -0,0 +1,495 @@
+package pillage
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// LayerResult holds the per-layer analysis results kept in the layer cache so
+// an image that reuses a layer does not have to analyze it again.
+type LayerResult struct {
+	Digest   string      `json:"digest"`
+	Files    []FileEntry `json:"files"`
+	Findings []Finding   `json:"findings,omitempty"`
+	Analyzed time.Time   `json:"analyzed"`
+	// Analyzers names the cacheable analyzers whose findings the result
+	// holds, see analyzerName.
+	Analyzers []string `json:"analyzers,omitempty"`
+}
+
+// LayerCache is a content-addressable cache of compressed layer blobs and
+// their analysis results, keyed by layer digest. It is shared by all images
+// of a run and, when the cache directory is kept, across runs.
+//
+// Layout:
+//
+//	<dir>/blobs/<algorithm>/<hex>        compressed layer blob
+//	<dir>/layers/<algorithm>/<hex>.json  LayerResult
+type LayerCache struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+	// inUse counts the images reading each layer. Layers in use are never
+	// evicted.
+	inUse map[string]int
+}
+
+// OpenLayerCache opens or creates a layer cache in dir. When maxSize is larger
+// than zero, least recently used entries are evicted once the cache grows
+// beyond maxSize bytes.
+func OpenLayerCache(dir string, maxSize int64) (*LayerCache, error) {
+	for _, sub := range []string{"blobs", "layers"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create layer cache: %w", err)
+		}
+	}
+	return &LayerCache{dir: dir, maxSize: maxSize, locks: map[string]*sync.Mutex{}, inUse: map[string]int{}}, nil
+}
+
+// Dir returns the cache directory.
+func (c *LayerCache) Dir() string {
+	return c.dir
+}
+
+func digestPath(root, digest, ext string) (string, error) {
+	algo, hex, ok := strings.Cut(digest, ":")
+	if !ok || algo == "" || hex == "" || strings.ContainsAny(digest, `/\.`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(root, algo, hex+ext), nil
+}
+
+// BlobPath returns where the compressed blob for digest is stored.
+func (c *LayerCache) BlobPath(digest string) (string, error) {
+	return digestPath(filepath.Join(c.dir, "blobs"), digest, "")
+}
+
+func (c *LayerCache) resultPath(digest string) (string, error) {
+	return digestPath(filepath.Join(c.dir, "layers"), digest, ".json")
+}
+
+// lock serializes work on a single digest so concurrent images sharing a
+// layer download it only once.
+func (c *LayerCache) lock(digest string) func() {
+	c.mu.Lock()
+	l, ok := c.locks[digest]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[digest] = l
+	}
+	c.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// pin protects the layers from eviction until the returned unpin is called.
+// Pins are counted, so a layer shared by several images is kept until the
+// last of them unpins it.
+func (c *LayerCache) pin(digests ...string) (unpin func()) {
+	c.mu.Lock()
+	for _, d := range digests {
+		c.inUse[d]++
+	}
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		for _, d := range digests {
+			if c.inUse[d]--; c.inUse[d] <= 0 {
+				delete(c.inUse, d)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// trim evicts least recently used layers beyond the maximum cache size.
+func (c *LayerCache) trim() {
+	if c.maxSize > 0 {
+		if _, _, err := c.Prune(c.maxSize); err != nil {
+			LogWarn("Failed to prune layer cache: %v", err)
+		}
+	}
+}
+
+func (c *LayerCache) used(digest string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inUse[digest] > 0
+}
+
+// touch marks a cache entry as recently used.
+func touch(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+// Has reports whether the compressed blob of digest is cached.
+func (c *LayerCache) Has(digest string) bool {
+	path, err := c.BlobPath(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Fetch returns the path of the cached compressed blob of the layer,
+// downloading it first if it is not cached yet.
+func (c *LayerCache) Fetch(layer v1.Layer) (string, error) {
+	return c.FetchResumable(layer, nil)
+}
+
+// FetchResumable is like Fetch, but an interrupted download is kept and
+// resumed with resume, both right away and by later runs sharing the cache.
+func (c *LayerCache) FetchResumable(layer v1.Layer, resume RangeFunc) (string, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return "", fmt.Errorf("failed to get layer digest: %w", err)
+	}
+	path, err := c.BlobPath(digest.String())
+	if err != nil {
+		return "", err
+	}
+
+	// Pinned before taking the lock, so a concurrent prune either sees the
+	// layer in use or removes it before it is looked up below. The caller
+	// keeps its own pin while it reads the blob.
+	defer c.pin(digest.String())()
+	unlock := c.lock(digest.String())
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		LogDebug("Layer %s found in cache", digest)
+		touch(path)
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// Partial downloads are hidden from the cache listing.
+	partial := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".partial")
+	for attempt := 0; ; attempt++ {
+		err = c.download(layer, partial, resume)
+		if err == nil {
+			break
+		}
+		var ierr *IntegrityError
+		if errors.As(err, &ierr) {
+			os.Remove(partial)
+			return "", err
+		}
+		if resume == nil || attempt == maxResumeAttempts {
+			if resume == nil {
+				os.Remove(partial)
+			}
+			return "", fmt.Errorf("failed downloading layer %s: %w", digest, err)
+		}
+		LogWarn("Download of layer %s interrupted, resuming: %v", digest, err)
+	}
+	if err := os.Rename(partial, path); err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+
+	c.trim()
+	return path, nil
+}
+
+// download writes the compressed blob of the layer to partial. Existing
+// content of partial is kept and completed with resume when possible. The
+// blob is checked against the digest and size of the layer's descriptor.
+func (c *LayerCache) download(layer v1.Layer, partial string, resume RangeFunc) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if info, err := os.Stat(partial); err == nil && resume != nil {
+		offset = info.Size()
+	}
+
+	var rc io.ReadCloser
+	if offset > 0 {
+		var err error
+		if rc, err = resume(offset); err != nil {
+			LogDebug("Cannot resume download at %d bytes, starting over: %v", offset, err)
+			rc, offset = nil, 0
+		} else {
+			LogDebug("Resuming download of %s at %d bytes", partial, offset)
+		}
+	}
+	if rc == nil {
+		var err error
+		if rc, err = layer.Compressed(); err != nil {
+			return fmt.Errorf("failed to get compressed stream: %w", blobError(digest.String(), err))
+		}
+	}
+	defer rc.Close()
+
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	got := func() (string, error) {
+		if offset > 0 {
+			return fileDigest(partial)
+		}
+		return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+	}
+	if err != nil {
+		// The registry client verifies blobs too and fails once it reaches
+		// their end. A blob read up to its declared size is judged by its own
+		// digest rather than by that error.
+		if size, serr := layer.Size(); serr == nil && offset+n >= size {
+			if sum, derr := got(); derr == nil {
+				if verr := verifyBlob(layer, sum, offset+n); verr != nil {
+					return verr
+				}
+			}
+		}
+		return blobError(digest.String(), err)
+	}
+
+	sum, err := got()
+	if err != nil {
+		return err
+	}
+	return verifyBlob(layer, sum, offset+n)
+}
+
+// fileDigest returns the sha256 digest of a file.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// Open returns a reader for the compressed layer, served from the cache.
+func (c *LayerCache) Open(layer v1.Layer) (io.ReadCloser, error) {
+	path, err := c.Fetch(layer)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// LoadResult returns the cached analysis results of a layer.
+func (c *LayerCache) LoadResult(digest string) (*LayerResult, bool) {
+	path, err := c.resultPath(digest)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var res LayerResult
+	if err := json.Unmarshal(data, &res); err != nil {
+		LogWarn("Ignoring corrupt layer cache entry %s: %v", path, err)
+		return nil, false
+	}
+	touch(path)
+	return &res, true
+}
+
+// HasResult reports whether analysis results of a layer are cached.
+func (c *LayerCache) HasResult(digest string) bool {
+	path, err := c.resultPath(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// SaveResult stores the analysis results of a layer.
+func (c *LayerCache) SaveResult(res *LayerResult) error {
+	path, err := c.resultPath(res.Digest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type cacheEntry struct {
+	digest string
+	size   int64
+	used   time.Time
+	paths  []string
+}
+
+// entries lists the cached layers with their combined size and last use.
+func (c *LayerCache) entries() ([]*cacheEntry, error) {
+	byDigest := map[string]*cacheEntry{}
+	for _, sub := range []string{"blobs", "layers"} {
+		root := filepath.Join(c.dir, sub)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, path)
+			algo, hex := filepath.Dir(rel), strings.TrimSuffix(filepath.Base(rel), ".json")
+			digest := algo + ":" + hex
+			e, ok := byDigest[digest]
+			if !ok {
+				e = &cacheEntry{digest: digest}
+				byDigest[digest] = e
+			}
+			e.size += info.Size()
+			e.paths = append(e.paths, path)
+			if info.ModTime().After(e.used) {
+				e.used = info.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	entries := make([]*cacheEntry, 0, len(byDigest))
+	for _, e := range byDigest {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	return entries, nil
+}
+
+// Size returns the total size of the cache in bytes and the number of layers.
+func (c *LayerCache) Size() (int64, int, error) {
+	entries, err := c.entries()
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	return total, len(entries), nil
+}
+
+// Prune evicts least recently used layers until the cache is at most maxSize
+// bytes. Layers pinned by an image being stored are kept, so the cache may
+// stay above maxSize until that image is done. It returns the number of layers
+// removed and the bytes freed.
+func (c *LayerCache) Prune(maxSize int64) (int, int64, error) {
+	entries, err := c.entries()
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	var removed int
+	var freed int64
+	for _, e := range entries {
+		if total <= maxSize {
+			break
+		}
+		evicted, err := c.evict(e)
+		if err != nil {
+			return removed, freed, err
+		}
+		if !evicted {
+			continue
+		}
+		LogDebug("Evicted layer %s from cache", e.digest)
+		total -= e.size
+		freed += e.size
+		removed++
+	}
+	return removed, freed, nil
+}
+
+// evict removes a cached layer unless it is pinned. Layers in use are
+// skipped before taking their lock, which their user may hold.
+func (c *LayerCache) evict(e *cacheEntry) (bool, error) {
+	if c.used(e.digest) {
+		return false, nil
+	}
+	unlock := c.lock(e.digest)
+	defer unlock()
+	if c.used(e.digest) {
+		return false, nil
+	}
+	for _, p := range e.paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ParseSize parses a human readable size such as "512MB", "10G" or "1024".
+// Units are powers of 1024.
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(size))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGTP", s[n-1]); i >= 0 {
+			mult = int64(1) << (10 * (i + 1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(n * float64(mult)), nil
+}
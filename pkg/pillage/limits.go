@@ -0,0 +1,136 @@
+package pillage
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Limits that stop the walk of a layer.
+const (
+	LimitLayerBytes = "layer-bytes" // decompressed bytes of a layer
+	LimitEntries    = "entries"     // tar entries of a layer
+	LimitFileSize   = "file-size"   // size of a single entry
+	LimitPathLength = "path-length" // length of an entry name or link target
+	LimitRatio      = "ratio"       // decompressed bytes per compressed byte
+)
+
+// ratioMinBytes is how much a layer must decompress to before the compression
+// ratio is checked, so small layers of zeros are not mistaken for bombs.
+const ratioMinBytes = 16 << 20
+
+// LayerLimits protects against archive bombs and pathological tarballs in the
+// images being scanned. A zero field uses the default, a negative one disables
+// the limit.
+type LayerLimits struct {
+	MaxLayerBytes int64   // decompressed bytes per layer
+	MaxEntries    int64   // entries per layer
+	MaxFileSize   int64   // size of a single entry
+	MaxPathLength int64   // length of entry names and link targets
+	MaxRatio      float64 // decompressed bytes per compressed byte
+}
+
+// DefaultLayerLimits are generous enough for real images, including large
+// Windows and machine learning layers.
+var DefaultLayerLimits = LayerLimits{
+	MaxLayerBytes: 64 << 30,
+	MaxEntries:    2_000_000,
+	MaxFileSize:   32 << 30,
+	MaxPathLength: 4096,
+	MaxRatio:      500,
+}
+
+// withDefaults returns the limits with zero fields set to their default.
+func (l LayerLimits) withDefaults() LayerLimits {
+	d := DefaultLayerLimits
+	if l.MaxLayerBytes != 0 {
+		d.MaxLayerBytes = l.MaxLayerBytes
+	}
+	if l.MaxEntries != 0 {
+		d.MaxEntries = l.MaxEntries
+	}
+	if l.MaxFileSize != 0 {
+		d.MaxFileSize = l.MaxFileSize
+	}
+	if l.MaxPathLength != 0 {
+		d.MaxPathLength = l.MaxPathLength
+	}
+	if l.MaxRatio != 0 {
+		d.MaxRatio = l.MaxRatio
+	}
+	return d
+}
+
+// LimitError reports a layer that exceeded one of its LayerLimits. The walk of
+// the layer stops, the other layers of the image are still processed.
+type LimitError struct {
+	Limit string
+	Value int64
+	Max   int64
+	Path  string // entry that exceeded the limit, if any
+}
+
+func (e *LimitError) Error() string {
+	msg := fmt.Sprintf("layer exceeds the %s limit: %d > %d", e.Limit, e.Value, e.Max)
+	if e.Limit == LimitRatio {
+		msg = fmt.Sprintf("layer exceeds the %s limit: %d:1 > %d:1", e.Limit, e.Value, e.Max)
+	}
+	if e.Path != "" {
+		msg += " at " + e.Path
+	}
+	return msg
+}
+
+// limitName returns the limit err exceeded, or an empty string.
+func limitName(err error) string {
+	var lerr *LimitError
+	if errors.As(err, &lerr) {
+		return lerr.Limit
+	}
+	return ""
+}
+
+// checkEntry checks the header of the n-th entry of a layer, counting from 1.
+func (l LayerLimits) checkEntry(n int64, hdr *tar.Header) error {
+	if l.MaxEntries > 0 && n > l.MaxEntries {
+		return &LimitError{Limit: LimitEntries, Value: n, Max: l.MaxEntries, Path: hdr.Name}
+	}
+	if l.MaxPathLength > 0 {
+		if size := int64(max(len(hdr.Name), len(hdr.Linkname))); size > l.MaxPathLength {
+			return &LimitError{Limit: LimitPathLength, Value: size, Max: l.MaxPathLength, Path: hdr.Name[:min(len(hdr.Name), 256)]}
+		}
+	}
+	if l.MaxFileSize > 0 && hdr.Size > l.MaxFileSize {
+		return &LimitError{Limit: LimitFileSize, Value: hdr.Size, Max: l.MaxFileSize, Path: hdr.Name}
+	}
+	return nil
+}
+
+// limitReader counts the decompressed bytes of a layer of compressed bytes and
+// fails once they exceed the byte or ratio limit. The error is returned again
+// by every later read, so it is not lost when an analyzer ignores it.
+type limitReader struct {
+	r          io.Reader
+	limits     LayerLimits
+	compressed int64
+	n          int64
+	err        error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if limit := l.limits.MaxLayerBytes; limit > 0 && l.n > limit {
+		l.err = &LimitError{Limit: LimitLayerBytes, Value: l.n, Max: limit}
+		return n, l.err
+	}
+	if ratio := l.limits.MaxRatio; ratio > 0 && l.compressed > 0 && l.n > ratioMinBytes && float64(l.n) > ratio*float64(l.compressed) {
+		l.err = &LimitError{Limit: LimitRatio, Value: l.n / l.compressed, Max: int64(ratio)}
+		return n, l.err
+	}
+	return n, err
+}
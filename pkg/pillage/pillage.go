@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	_ "embed"
 	"encoding/json"
 	"errors"
@@ -24,27 +25,37 @@ import (
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
 // ImageData represents an image enumerated from a registry or alternatively an error that occured while enumerating a registry.
 type ImageData struct {
-	Reference  string
-	Registry   string
-	Repository string
-	Tag        string
-	Manifest   string
-	Config     string
-	Error      error
-	Image      v1.Image
+	Reference   string
+	Registry    string
+	Repository  string
+	Tag         string
+	Digest      string
+	Manifest    string
+	Config      string
+	Error       error
+	Image       v1.Image
+	Findings    []Finding
+	Recovered   []RecoveredFile
+	LayerErrors []LayerError
+
+	remote     bool                // Image reads from a registry
+	layerFiles map[int][]FileEntry // inventory of the layers read, by number
+	base       *BaseImage          // detected by Store from the scan database
 }
 
 // Manifest represents the image manifest layers metadata.
 type Manifest struct {
 	Layers []struct {
-		Digest    string `json:"digest"`
-		Size      int64  `json:"size"`
-		MediaType string `json:"mediaType"`
+		Digest    string   `json:"digest"`
+		Size      int64    `json:"size"`
+		MediaType string   `json:"mediaType"`
+		URLs      []string `json:"urls,omitempty"`
 	} `json:"layers"`
 }
 
@@ -54,10 +65,26 @@ type StorageOptions struct {
 	OutputPath     string
 	StoreImages    bool
 	CraneOptions   []crane.Option
-	FilterSmall    int64
+	Auth           authn.Authenticator // for resumed downloads, nil for the keychain
+	LayerWorkers   int                 // layers downloaded at once per image
+	FilterSmall    int64               // maximum layer size in bytes, 0 for no limit
+	MinLayerSize   int64
+	MaxImageSize   int64 // images whose layers add up to more are skipped
+	ImageBudget    int64 // maximum bytes downloaded per image
+	Budget         *DownloadBudget
 	StoreTarballs  bool
 	WhiteOut       bool
 	WhiteOutFilter []string
+	Shadowed       bool
+	ScanSecrets    bool            // run the built-in regex secret analyzer
+	FetchForeign   bool            // fetch non-distributable layers from their URLs
+	SkipLayers     map[string]bool // layers left out by digest, e.g. shared with an image being compared
+	Limits         LayerLimits     // archive bomb protection, zero fields use the defaults
+	DB             *ScanDB
+	Cache          *LayerCache
+	// Analyzers add analyzers to the built-in ones. Each function is called
+	// once per image, so analyzers may keep per-image state.
+	Analyzers []func() Analyzer
 }
 
 //go:embed default_config.json
@@ -69,14 +96,17 @@ type BruteForceConfig struct {
 	Names []string `json:"names"`
 }
 
-// FileVersion tracks the bytes of a file and the layer it was found in.
-// FileVersion tracks the path to a temporary file containing the bytes of a
-// file and the layer it was found in. Storing file contents on disk avoids
-// keeping all file data in memory while processing large images.
+// FileVersion indexes a version of a file: the layer and position of its tar
+// entry, its size and digest. Its content is read again from the layer when
+// it needs to be restored, so no copy of the files of an image is kept.
 type FileVersion struct {
 	Layer    int
-	Path     string
+	Entry    int // position of the entry in the layer, starting at 0
+	Size     int64
 	TypeFlag byte
+	Digest   string
+	Header   *tar.Header
+	Deleted  int // layer that deleted the version, 0 while it is visible
 }
 
 // MakeCraneOptions returns crane.Options for secure or insecure registry access
@@ -95,6 +125,20 @@ func MakeCraneOptions(insecure bool, auth authn.Authenticator) (options []crane.
 	return options
 }
 
+// ShareTransport returns options that make every registry call made with
+// them reuse the same connections and tokens, so a registry is pinged and a
+// token is exchanged once per repository rather than once per request.
+func ShareTransport(options []crane.Option) []crane.Option {
+	puller, err := remote.NewPuller(crane.GetOptions(options...).Remote...)
+	if err != nil {
+		LogWarn("Cannot share registry transport: %v", err)
+		return options
+	}
+	return append(options[:len(options):len(options)], func(o *crane.Options) {
+		o.Remote = append(o.Remote, remote.Reuse(puller))
+	})
+}
+
 func securejoin(paths ...string) (out string) {
 	for _, path := range paths {
 		out = filepath.Join(out, filepath.Clean("/"+path))
@@ -102,18 +146,17 @@ func securejoin(paths ...string) (out string) {
 	return out
 }
 
-func shouldFilterWhiteout(name string, options *StorageOptions) bool {
-	if len(options.WhiteOutFilter) == 0 {
-		return false
-	}
+// whiteoutFilterMatch returns the --whiteout-filter pattern matching name, or
+// an empty string.
+func whiteoutFilterMatch(name string, options *StorageOptions) string {
 	lower := strings.ToLower(name)
 	for _, pattern := range options.WhiteOutFilter {
 		match, err := doublestar.PathMatch(strings.ToLower(pattern), lower)
 		if err == nil && match {
-			return true
+			return pattern
 		}
 	}
-	return false
+	return ""
 }
 
 // Store retrieves and processes the image layers according to StorageOptions.
@@ -127,7 +170,7 @@ func (image *ImageData) Store(options *StorageOptions) error {
 	if opts.CachePath == "." {
 		tmpDir, err := os.MkdirTemp("", "pilreg-tmp-")
 		if err != nil {
-			fmt.Println("Failed to create temp dir:", err)
+			LogError("Failed to create temp dir: %v", err)
 			return err
 		}
 		defer os.RemoveAll(tmpDir) // clean up
@@ -142,16 +185,28 @@ func (image *ImageData) Store(options *StorageOptions) error {
 		return err
 	}
 
-	// Temporary directory used to store file versions so that memory usage
-	// does not grow with the size of the image.
+	// Temporary directory holding large entries while several analyzers read
+	// them, so that memory usage does not grow with the size of a file.
 	tempDir := filepath.Join(imagePath, "filecache")
 	if err := os.MkdirAll(tempDir, 0o755); err != nil {
 		return fmt.Errorf("error creating temp dir: %w", err)
 	}
 	defer os.RemoveAll(tempDir)
 
+	if opts.DB != nil && image.Error == nil {
+		image.base = image.detectBase(opts.DB)
+	}
+
+	if opts.Cache == nil {
+		cache, err := OpenLayerCache(cachePath, 0)
+		if err != nil {
+			return err
+		}
+		opts.Cache = cache
+	}
+
 	if image.Error == nil {
-		if opts.WhiteOut || opts.StoreImages || opts.StoreTarballs {
+		if opts.WhiteOut || opts.Shadowed || opts.ScanSecrets || opts.StoreImages || opts.StoreTarballs || len(opts.Analyzers) > 0 {
 			var parsed Manifest
 			err := json.Unmarshal([]byte(image.Manifest), &parsed)
 			if err != nil {
@@ -159,7 +214,35 @@ func (image *ImageData) Store(options *StorageOptions) error {
 				return err
 			}
 
-			var previousFiles = make(map[string][]FileVersion)
+			var total int64
+			for _, layer := range parsed.Layers {
+				total += layer.Size
+			}
+			if opts.MaxImageSize > 0 && total > opts.MaxImageSize {
+				reason := fmt.Sprintf("layers add up to %d bytes, more than the maximum image size %d", total, opts.MaxImageSize)
+				LogWarn("Skipping %s: %s", image.Reference, reason)
+				for idx, layer := range parsed.Layers {
+					image.deferLayer(idx+1, layer.Digest, layer.MediaType, reason)
+				}
+				return nil
+			}
+			// The layers stay in the cache until the image is done with them,
+			// then the cache is trimmed back to its maximum size.
+			digests := make([]string, len(parsed.Layers))
+			for idx, layer := range parsed.Layers {
+				digests[idx] = layer.Digest
+			}
+			unpin := opts.Cache.pin(digests...)
+			defer func() {
+				unpin()
+				opts.Cache.trim()
+			}()
+			imageBudget := NewDownloadBudget(opts.ImageBudget)
+
+			processor := NewLayerProcessor(image, &opts, tempDir, opts.imageAnalyzers(tempDir)...)
+			processor.Start()
+			defer processor.Finish()
+
 			var imgLayers []v1.Layer
 			if image.Image != nil {
 				imgLayers, err = image.Image.Layers()
@@ -169,25 +252,83 @@ func (image *ImageData) Store(options *StorageOptions) error {
 				}
 			}
 
+			var infos []*LayerInfo
+			var srcs []v1.Layer
 			for idx, layer := range parsed.Layers {
-				layerDir := filepath.Join(imagePath, strings.ReplaceAll(layer.Digest, ":", "_"))
+				if opts.SkipLayers[layer.Digest] {
+					LogDebug("Skipping layer %d (%s) of %s", idx+1, layer.Digest, image.Reference)
+					continue
+				}
+				foreign := isForeignLayer(layer.MediaType)
+				if foreign {
+					image.Findings = append(image.Findings, foreignLayerFinding(image, idx+1, layer.Digest, layer.URLs))
+				}
+				if err := checkLayerMediaType(layer.MediaType); err != nil && !(foreign && opts.FetchForeign) {
+					LogWarn("Skipping layer %d (%s) of %s: %v", idx+1, layer.Digest, image.Reference, err)
+					image.addLayerError(idx+1, layer.Digest, layer.MediaType, err.Error(), true, layer.URLs...)
+					continue
+				}
+				reason, reserved := opts.skipLayer(layer.Digest, layer.Size, imageBudget)
+				if reason != "" {
+					LogWarn("Skipping layer %d (%s) of %s: %s", idx+1, layer.Digest, image.Reference, reason)
+					image.deferLayer(idx+1, layer.Digest, layer.MediaType, reason)
+					continue
+				}
+
+				layerDir := filepath.Join(imagePath, layerDirName(layer.Digest))
+				if opts.StoreImages || opts.StoreTarballs {
+					layerDir = filepath.Join(ImageFSDir(opts.OutputPath, image), layerDirName(layer.Digest))
+				}
 
 				err := os.MkdirAll(layerDir, 0755)
 				if err != nil {
 					LogInfo("Failed to create dir %s: %v", layerDir, err)
+					opts.refund(reserved, imageBudget)
 					continue
 				}
 
-				if image.Image != nil {
-					err = EnumLayerFromLayer(image, layerDir, imgLayers[idx], idx+1, &opts, previousFiles, tempDir)
+				info := &LayerInfo{Index: idx + 1, Digest: layer.Digest, MediaType: layer.MediaType, Size: layer.Size, Dir: layerDir, reserved: reserved}
+				var src v1.Layer
+				if foreign {
+					if src, err = newForeignLayer(layer.Digest, layer.Size, layer.MediaType, layer.URLs, &opts); err != nil {
+						LogWarn("Skipping layer %d (%s) of %s: %v", idx+1, layer.Digest, image.Reference, err)
+						image.addLayerError(idx+1, layer.Digest, layer.MediaType, err.Error(), true, layer.URLs...)
+						opts.refund(reserved, imageBudget)
+						continue
+					}
+				} else if image.Image != nil {
+					src = imgLayers[idx]
 				} else {
 					layerRef := fmt.Sprintf("%s@%s", image.Reference, layer.Digest)
-					err = EnumLayer(image, layerDir, layerRef, idx+1, &opts, opts.CraneOptions, previousFiles, tempDir)
+					if src, err = crane.PullLayer(layerRef, opts.CraneOptions...); err != nil {
+						LogWarn("Failed processing layer %s: %v", layer.Digest, err)
+						image.addLayerError(idx+1, layer.Digest, layer.MediaType, fmt.Sprintf("pull failed for layer %s: %v", layerRef, err), false)
+						opts.refund(reserved, imageBudget)
+						continue
+					}
+				}
+				if !foreign && (image.Image == nil || image.remote) {
+					info.resume = registryRange(image.Reference, layer.Digest, layer.Size, &opts)
+				}
+				infos = append(infos, info)
+				srcs = append(srcs, src)
+			}
+
+			// Layers are downloaded in parallel but walked in manifest order.
+			wait, stop := processor.prefetch(infos, srcs, opts.LayerWorkers)
+			defer stop()
+			for i, info := range infos {
+				err := wait(i)
+				if err == nil {
+					err = processor.ProcessLayer(info, srcs[i])
+				} else {
+					// The layer was not downloaded, its budget is free again.
+					opts.refund(info.reserved, imageBudget)
 				}
 				if err != nil {
-					LogWarn("Failed processing layer %s: %v", layer.Digest, err)
+					LogWarn("Failed processing layer %s: %v", info.Digest, err)
 					LogDebug("%s\n%s", image.Manifest, image.Config)
-					continue
+					image.addLayerFailure(info, err)
 				}
 			}
 		}
@@ -204,363 +345,55 @@ func (image *ImageData) Store(options *StorageOptions) error {
 	return image.Error
 }
 
-// EnumLayer pulls the specified layer reference and unpacks it into a temporary cache,
-// tracking previous versions for whiteout processing and optionally storing tarballs.
-func EnumLayer(image *ImageData, layerDir, layerRef string, layerNumber int, storageOptions *StorageOptions, craneOpts []crane.Option, previousFiles map[string][]FileVersion, tempDir string) error {
-	crLayer, err := crane.PullLayer(layerRef, craneOpts...)
-	if err != nil {
-		return fmt.Errorf("pull failed for layer %s: %w", layerRef, err)
+// imageAnalyzers returns the analyzers run on the layers of one image: the
+// built-in ones enabled by the options followed by the registered ones.
+func (opts *StorageOptions) imageAnalyzers(tempDir string) []Analyzer {
+	var analyzers []Analyzer
+	if opts.StoreImages {
+		analyzers = append(analyzers, &fsAnalyzer{})
 	}
-
-	rc, err := crLayer.Compressed()
-	if err != nil {
-		return fmt.Errorf("failed to get compressed stream: %w", err)
+	if opts.WhiteOut || opts.Shadowed {
+		analyzers = append(analyzers, newRecoveryAnalyzer(opts, tempDir))
 	}
-	defer rc.Close()
-
-	var tarReader *tar.Reader
-
-	if storageOptions.StoreTarballs {
-		tarPath := filepath.Join(layerDir, "filesystem.tar")
-		f, err := os.Create(tarPath)
-		if err != nil {
-			return fmt.Errorf("cannot create tarball: %w", err)
-		}
-		if _, err := io.Copy(f, rc); err != nil {
-			f.Close()
-			return fmt.Errorf("failed writing tarball: %w", err)
-		}
-		f.Close()
-
-		tarFile, err := os.Open(tarPath)
-		if err != nil {
-			return fmt.Errorf("cannot reopen tarball: %w", err)
-		}
-		defer tarFile.Close()
-
-		gzr, err := gzip.NewReader(tarFile)
-		if err != nil {
-			return fmt.Errorf("gzip decompress failed: %w", err)
-		}
-		tarReader = tar.NewReader(gzr)
-	} else {
-		// Save original to close it later
-		originalRC := rc
-		defer originalRC.Close()
-
-		// Peek first few bytes to check for gzip magic header
-		buf := make([]byte, 2)
-		if _, err := io.ReadFull(rc, buf); err != nil {
-			return fmt.Errorf("peek error: %w", err)
-		}
-
-		// Restore peeked bytes into stream
-		rc = io.NopCloser(io.MultiReader(bytes.NewReader(buf), rc))
-
-		// Check for gzip magic numbers
-		isGzip := buf[0] == 0x1f && buf[1] == 0x8b
-		if isGzip {
-			gzr, err := gzip.NewReader(rc)
-			if err != nil {
-				return fmt.Errorf("gzip decompress failed: %w", err)
-			}
-			defer gzr.Close()
-			tarReader = tar.NewReader(gzr)
-		} else {
-			tarReader = tar.NewReader(rc)
-		}
-
+	if opts.ScanSecrets {
+		analyzers = append(analyzers, secretAnalyzer{})
 	}
-
-	// Determine where to write restored files
-	var resultsDir string
-	resultsDir = filepath.Join(storageOptions.OutputPath, "results", securejoin(image.Registry, image.Repository, image.Tag))
-	// Prepare the output path, but delay creation until needed
-	createdResultsDir := false
-
-	// if err := os.MkdirAll(resultsDir, 0755); err != nil {
-	// 	return fmt.Errorf("failed to create results dir: %w", err)
-	// }
-
-	for {
-		hdr, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			LogInfo("Error reading tar entry: %v", err)
-			break
-		}
-
-		base := filepath.Base(hdr.Name)
-
-		if strings.HasPrefix(base, ".wh.") {
-			LogDebug("Whiteout file detected: ", hdr.Name)
-			deletedPath := filepath.Join(filepath.Dir(hdr.Name), strings.TrimPrefix(base, ".wh."))
-			deletedPath = strings.TrimPrefix(deletedPath, string(filepath.Separator))
-
-			// Helper to create the results directory once
-			ensureResultsDir := func() bool {
-				if createdResultsDir {
-					return true
-				}
-				if err := os.MkdirAll(resultsDir, 0755); err != nil {
-					LogInfo("Failed to create dir for results: %v", err)
-					return false
-				}
-				createdResultsDir = true
-				return true
-			}
-
-			restoreFile := func(name string, data []byte, typ byte) {
-				if shouldFilterWhiteout(name, storageOptions) {
-					LogDebug("Skipping filtered whiteout file: %s", name)
-					return
-				}
-				if len(data) == 0 && typ == tar.TypeReg {
-					LogDebug("Skipping empty file: %s", name)
-					return
-				}
-				if !ensureResultsDir() {
-					return
-				}
-				sanitizedName := strings.TrimPrefix(filepath.Clean("/"+name), "/")
-				restorePath := filepath.Join(resultsDir, fmt.Sprintf("%s.%d", sanitizedName, layerNumber))
-				if err := os.MkdirAll(filepath.Dir(restorePath), 0755); err != nil {
-					LogInfo("Failed to create dir for %s: %v", restorePath, err)
-					return
-				}
-				f, err := os.Create(restorePath)
-				if err != nil {
-					LogInfo("Failed to create restore file %s: %v", restorePath, err)
-					return
-				}
-				if _, err := f.Write(data); err != nil {
-					LogInfo("Error restoring file %s: %v", restorePath, err)
-				}
-				f.Close()
-				LogInfo("Restored whiteout-deleted file to %s", restorePath)
-			}
-
-			// Restore a single file if present
-			if versions, ok := previousFiles[deletedPath]; ok && len(versions) > 0 {
-				data, err := os.ReadFile(versions[len(versions)-1].Path)
-				if err != nil {
-					LogInfo("Error reading cached file %s: %v", versions[len(versions)-1].Path, err)
-				} else {
-					restoreFile(deletedPath, data, versions[len(versions)-1].TypeFlag)
-				}
-			} else {
-				LogDebug("No previous version found for deleted file %s", deletedPath)
-			}
-
-			// Restore any files contained in a deleted directory
-			prefix := deletedPath + string(filepath.Separator)
-			for name, versions := range previousFiles {
-				if strings.HasPrefix(name, prefix) && len(versions) > 0 {
-					data, err := os.ReadFile(versions[len(versions)-1].Path)
-					if err != nil {
-						LogInfo("Error reading cached file %s: %v", versions[len(versions)-1].Path, err)
-						continue
-					}
-					restoreFile(name, data, versions[len(versions)-1].TypeFlag)
-				} else {
-					LogDebug("No previous version found for deleted directory file %s", name)
-				}
-			}
-
-			//} else if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeDir {
-		} else {
-			tempFile, err := os.CreateTemp(tempDir, "file-")
-			if err != nil {
-				LogInfo("Error creating temp file for %s: %v", hdr.Name, err)
-				io.Copy(io.Discard, tarReader)
-				continue
-			}
-			if _, err := io.Copy(tempFile, tarReader); err == nil {
-				tempFile.Close()
-				name := strings.TrimPrefix(hdr.Name, string(filepath.Separator))
-				previousFiles[name] = append(previousFiles[name], FileVersion{Layer: layerNumber, Path: tempFile.Name(), TypeFlag: hdr.Typeflag})
-			} else {
-				tempFile.Close()
-				os.Remove(tempFile.Name())
-				LogInfo("Error reading file %s from tar: %v", hdr.Name, err)
-				continue
-			}
-		}
+	analyzers = append(analyzers, inventoryAnalyzer{})
+	for _, newAnalyzer := range opts.Analyzers {
+		analyzers = append(analyzers, newAnalyzer())
 	}
-
-	return nil
+	return analyzers
 }
 
-// EnumLayerFromLayer processes an already fetched layer object similarly to EnumLayer,
-// extracting files and tracking whiteout operations.
-func EnumLayerFromLayer(image *ImageData, layerDir string, layer v1.Layer, layerNumber int, storageOptions *StorageOptions, previousFiles map[string][]FileVersion, tempDir string) error {
-	rc, err := layer.Compressed()
-	if err != nil {
-		return fmt.Errorf("failed to get compressed stream: %w", err)
-	}
-	defer rc.Close()
-
-	var tarReader *tar.Reader
-
-	if storageOptions.StoreTarballs {
-		tarPath := filepath.Join(layerDir, "filesystem.tar")
-		f, err := os.Create(tarPath)
-		if err != nil {
-			return fmt.Errorf("cannot create tarball: %w", err)
-		}
-		if _, err := io.Copy(f, rc); err != nil {
-			f.Close()
-			return fmt.Errorf("failed writing tarball: %w", err)
+// useCachedResult applies the cached analysis results of a layer to the image
+// instead of analyzing the layer again.
+func useCachedResult(image *ImageData, res *LayerResult, storageOptions *StorageOptions) {
+	LogDebug("Using cached analysis of layer %s for %s", res.Digest, image.Reference)
+	for _, f := range res.Findings {
+		if f.Source == secretSource && !storageOptions.ScanSecrets {
+			continue
 		}
-		f.Close()
-
-		tarFile, err := os.Open(tarPath)
-		if err != nil {
-			return fmt.Errorf("cannot reopen tarball: %w", err)
-		}
-		defer tarFile.Close()
-
-		gzr, err := gzip.NewReader(tarFile)
-		if err != nil {
-			return fmt.Errorf("gzip decompress failed: %w", err)
-		}
-		tarReader = tar.NewReader(gzr)
-	} else {
-		originalRC := rc
-		defer originalRC.Close()
-
-		buf := make([]byte, 2)
-		if _, err := io.ReadFull(rc, buf); err != nil {
-			return fmt.Errorf("peek error: %w", err)
-		}
-
-		rc = io.NopCloser(io.MultiReader(bytes.NewReader(buf), rc))
-
-		isGzip := buf[0] == 0x1f && buf[1] == 0x8b
-		if isGzip {
-			gzr, err := gzip.NewReader(rc)
-			if err != nil {
-				return fmt.Errorf("gzip decompress failed: %w", err)
-			}
-			defer gzr.Close()
-			tarReader = tar.NewReader(gzr)
-		} else {
-			tarReader = tar.NewReader(rc)
-		}
-
+		f.Image = image.Reference
+		image.Findings = append(image.Findings, f)
 	}
-
-	var resultsDir string
-	resultsDir = filepath.Join(storageOptions.OutputPath, "results", securejoin(image.Registry, image.Repository, image.Tag))
-	createdResultsDir := false
-
-	for {
-		hdr, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			LogInfo("Error reading tar entry: %v", err)
-			break
+	if storageOptions.DB != nil {
+		if err := storageOptions.DB.RecordLayerFiles(res.Digest, res.Files); err != nil {
+			LogWarn("Failed recording files of layer %s: %v", res.Digest, err)
 		}
+	}
+}
 
-		base := filepath.Base(hdr.Name)
-
-		if strings.HasPrefix(base, ".wh.") {
-			LogDebug("Whiteout file detected: ", hdr.Name)
-			deletedPath := filepath.Join(filepath.Dir(hdr.Name), strings.TrimPrefix(base, ".wh."))
-			deletedPath = strings.TrimPrefix(deletedPath, string(filepath.Separator))
-
-			ensureResultsDir := func() bool {
-				if createdResultsDir {
-					return true
-				}
-				if err := os.MkdirAll(resultsDir, 0755); err != nil {
-					LogInfo("Failed to create dir for results: %v", err)
-					return false
-				}
-				createdResultsDir = true
-				return true
-			}
-
-			restoreFile := func(name string, data []byte, typ byte) {
-				if shouldFilterWhiteout(name, storageOptions) {
-					LogDebug("Skipping filtered whiteout file: %s", name)
-					return
-				}
-				if len(data) == 0 && typ == tar.TypeReg {
-					LogDebug("Skipping empty file: %s", name)
-					return
-				}
-				if !ensureResultsDir() {
-					return
-				}
-				sanitizedName := strings.TrimPrefix(filepath.Clean("/"+name), "/")
-				restorePath := filepath.Join(resultsDir, fmt.Sprintf("%s.%d", sanitizedName, layerNumber))
-				if err := os.MkdirAll(filepath.Dir(restorePath), 0755); err != nil {
-					LogInfo("Failed to create dir for %s: %v", restorePath, err)
-					return
-				}
-				f, err := os.Create(restorePath)
-				if err != nil {
-					LogInfo("Failed to create restore file %s: %v", restorePath, err)
-					return
-				}
-				if _, err := f.Write(data); err != nil {
-					LogInfo("Error restoring file %s: %v", restorePath, err)
-				}
-				f.Close()
-				LogInfo("Restored whiteout-deleted file to %s", restorePath)
-			}
-
-			if versions, ok := previousFiles[deletedPath]; ok && len(versions) > 0 {
-				data, err := os.ReadFile(versions[len(versions)-1].Path)
-				if err != nil {
-					LogInfo("Error reading cached file %s: %v", versions[len(versions)-1].Path, err)
-				} else {
-					restoreFile(deletedPath, data, versions[len(versions)-1].TypeFlag)
-				}
-			} else {
-				LogDebug("No previous version found for deleted file %s", deletedPath)
-			}
-
-			prefix := deletedPath + string(filepath.Separator)
-			for name, versions := range previousFiles {
-				if strings.HasPrefix(name, prefix) && len(versions) > 0 {
-					data, err := os.ReadFile(versions[len(versions)-1].Path)
-					if err != nil {
-						LogInfo("Error reading cached file %s: %v", versions[len(versions)-1].Path, err)
-						continue
-					}
-					restoreFile(name, data, versions[len(versions)-1].TypeFlag)
-				} else {
-					LogDebug("No previous version found for deleted directory file %s", name)
-				}
-			}
-
-		} else {
-			tempFile, err := os.CreateTemp(tempDir, "file-")
-			if err != nil {
-				LogInfo("Error creating temp file for %s: %v", hdr.Name, err)
-				io.Copy(io.Discard, tarReader)
-				continue
-			}
-			if _, err := io.Copy(tempFile, tarReader); err == nil {
-				tempFile.Close()
-				name := strings.TrimPrefix(hdr.Name, string(filepath.Separator))
-				previousFiles[name] = append(previousFiles[name], FileVersion{Layer: layerNumber, Path: tempFile.Name(), TypeFlag: hdr.Typeflag})
-			} else {
-				tempFile.Close()
-				os.Remove(tempFile.Name())
-				LogInfo("Error reading file %s from tar: %v", hdr.Name, err)
-				continue
-			}
+// saveLayerResult stores the analysis results of a freshly analyzed layer in
+// the layer cache and the scan database.
+func saveLayerResult(res *LayerResult, storageOptions *StorageOptions) {
+	if err := storageOptions.Cache.SaveResult(res); err != nil {
+		LogWarn("Failed caching results of layer %s: %v", res.Digest, err)
+	}
+	if storageOptions.DB != nil {
+		if err := storageOptions.DB.RecordLayerFiles(res.Digest, res.Files); err != nil {
+			LogWarn("Failed recording files of layer %s: %v", res.Digest, err)
 		}
 	}
-
-	return nil
 }
 
 // EnumImage will read a specific image from a remote registry and returns the result asynchronously.
@@ -568,6 +401,9 @@ func EnumImage(reg string, repo string, tag string, options ...crane.Option) <-c
 	out := make(chan *ImageData)
 
 	ref := fmt.Sprintf("%s/%s:%s", reg, repo, tag)
+	if strings.HasPrefix(tag, "sha256:") {
+		ref = fmt.Sprintf("%s/%s@%s", reg, repo, tag)
+	}
 
 	go func(ref string) {
 		defer close(out)
@@ -579,43 +415,73 @@ func EnumImage(reg string, repo string, tag string, options ...crane.Option) <-c
 			Tag:        tag,
 		}
 
-		var manifest Manifest
-
+		// The manifest is fetched once and the image built from it is reused
+		// by Store, so layers are not looked up by reference again.
+		o := crane.GetOptions(options...)
+		var desc *remote.Descriptor
 		var unparsedmanifest []byte
 		err := retryWithBackoff(5, 60*time.Second, func() error {
-			m, err := crane.Manifest(ref, options...)
+			r, err := name.ParseReference(ref, o.Name...)
+			if err != nil {
+				return err
+			}
+			desc, err = remote.Get(r, o.Remote...)
 			if err == nil {
-				unparsedmanifest = m
+				unparsedmanifest = desc.Manifest
 			}
 			return err
 		})
 		if err != nil {
 			LogError("Error fetching manifest for image %s: %s", ref, err)
 			result.Error = err
+		} else {
+			result.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(unparsedmanifest))
 		}
 
-		err = json.Unmarshal([]byte(unparsedmanifest), &manifest)
-		if err != nil {
+		if result.Manifest, err = formatManifest(unparsedmanifest); err != nil {
 			LogInfo("Error parsing manifest for image %s: %s", ref, err)
 			result.Error = err
 		}
 
-		strManifest, err := json.MarshalIndent(manifest, "", "  ")
-		if err != nil {
-			LogInfo("Error fetching parsing Manifest for image %s: %s", ref, err)
+		if desc == nil {
+			out <- result
+			return
 		}
-		result.Manifest = string(strManifest)
 
-		var config []byte
+		var config, platformManifest []byte
 		err = retryWithBackoff(5, 60*time.Second, func() error {
-			m, err := crane.Config(ref, options...)
-			if err == nil {
-				config = m
+			// An index resolves to the image of the configured platform.
+			img, err := desc.Image()
+			if err != nil {
+				return err
 			}
-			return err
+			raw, err := img.RawManifest()
+			if err != nil {
+				return err
+			}
+			if config, err = img.RawConfigFile(); err != nil {
+				if m, perr := v1.ParseManifest(bytes.NewReader(raw)); perr == nil {
+					return configError(ref, m.Config, err, options)
+				}
+				return err
+			}
+			result.Image = img
+			if desc.MediaType.IsIndex() {
+				platformManifest = raw
+			}
+			return nil
 		})
 
-		if err != nil {
+		// The image of an index is stored with its own manifest, which lists
+		// the layers read by Store.
+		if platformManifest != nil {
+			if m, err := formatManifest(platformManifest); err == nil {
+				result.Manifest = m
+				result.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(platformManifest))
+			}
+		}
+
+		if err != nil && !result.addIntegrityFinding(err) {
 			LogInfo("Error fetching config for image %s: %s (the config may be in the manifest itself)", ref, err)
 
 			errStr := err.Error()
@@ -626,6 +492,7 @@ func EnumImage(reg string, repo string, tag string, options ...crane.Option) <-c
 			}
 		}
 		result.Config = string(config)
+		result.remote = true
 
 		out <- result
 	}(ref)
@@ -633,6 +500,29 @@ func EnumImage(reg string, repo string, tag string, options ...crane.Option) <-c
 	return out
 }
 
+// formatManifest returns the indented JSON of an image manifest. A manifest
+// that fails to parse is returned with the fields read so far.
+func formatManifest(raw []byte) (string, error) {
+	var manifest Manifest
+	err := json.Unmarshal(raw, &manifest)
+	formatted, merr := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = merr
+	}
+	return string(formatted), err
+}
+
+// FetchImage reads a single image from a registry. ref names it by tag or by
+// digest, e.g. registry.example.com/app:1.4 or registry.example.com/app@sha256:….
+func FetchImage(ref string, options ...crane.Option) (*ImageData, error) {
+	r, err := name.ParseReference(ref, crane.GetOptions(options...).Name...)
+	if err != nil {
+		return nil, err
+	}
+	image := <-EnumImage(r.Context().RegistryStr(), r.Context().RepositoryStr(), r.Identifier(), options...)
+	return image, image.Error
+}
+
 // EnumRepository will read all images tagged in a specific repository on a remote registry and returns the results asynchronously.
 // If a list of tags is not supplied, a list will be enumerated from the registry's API.
 func EnumRepository(reg string, repo string, tags []string, options ...crane.Option) <-chan *ImageData {
@@ -826,6 +716,12 @@ func EnumTarball(tarPath string) <-chan *ImageData {
 					continue
 				}
 
+				digest, err := img.Digest()
+				if err != nil {
+					out <- &ImageData{Reference: tagStr, Error: err}
+					continue
+				}
+
 				sanitizedRef := fmt.Sprintf("%s:%s", tag.Repository.RepositoryStr(), tag.TagStr())
 
 				out <- &ImageData{
@@ -833,6 +729,7 @@ func EnumTarball(tarPath string) <-chan *ImageData {
 					Registry:   tag.RegistryStr(),
 					Repository: tag.RepositoryStr(),
 					Tag:        tag.TagStr(),
+					Digest:     digest.String(),
 					Manifest:   string(man),
 					Config:     string(cfg),
 					Image:      img,
@@ -878,16 +775,20 @@ func ValidateTarball(path string) error {
 }
 
 // RunTruffleHog invokes the trufflehog binary against a Docker image reference,
-// logging the output and returning an error on non-zero exit.
+// recording any secrets it reports as findings on the image and returning an
+// error on non-zero exit.
 func RunTruffleHog(imageRef *ImageData) error {
 	image := securejoin(imageRef.Registry, imageRef.Repository, imageRef.Tag)
-	cmd := exec.Command("trufflehog", "docker", fmt.Sprintf("--image=%s", image))
+	cmd := exec.Command("trufflehog", "docker", "--json", fmt.Sprintf("--image=%s", image))
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		LogInfo("trufflehog failed for %s: %v\nOutput:\n%s", image, err, string(output))
 		return err
 	}
-	LogInfo("trufflehog completed for %s:\n%s", image, string(output))
+	findings := parseTruffleHog(imageRef.Reference, output)
+	imageRef.Findings = append(imageRef.Findings, findings...)
+	LogInfo("trufflehog completed for %s with %d findings", image, len(findings))
+	LogDebug("trufflehog output for %s:\n%s", image, string(output))
 	return nil
 }
 
@@ -901,6 +802,11 @@ func retryWithBackoff(attempts int, baseDelay time.Duration, op func() error) er
 		if err == nil {
 			return nil
 		}
+		// A blob that is missing or does not match its digest will not change
+		var ierr *IntegrityError
+		if errors.As(err, &ierr) {
+			return err
+		}
 		// If authentication error, do not retry; skip permanently
 		errStr := err.Error()
 		if strings.Contains(errStr, "UNAUTHORIZED") || strings.Contains(errStr, "authentication required") {
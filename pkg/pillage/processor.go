@@ -0,0 +1,472 @@
+package pillage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Analyzer inspects the layers of an image. A LayerProcessor walks every
+// layer once and hands each tar entry to all of its analyzers, in layer order.
+//
+// An analyzer is used for a single image at a time. OnEntry receives a reader
+// of the entry's content which is only valid until OnEntry returns; it does
+// not need to be read to the end. An error from OnEntry or OnLayerEnd fails
+// the layer.
+type Analyzer interface {
+	OnImageStart(image *ImageData) error
+	OnEntry(layer *LayerInfo, hdr *tar.Header, r io.Reader) error
+	OnLayerEnd(layer *LayerInfo) error
+	OnImageEnd(image *ImageData) error
+}
+
+// CacheableAnalyzer is implemented by analyzers whose results only depend on
+// the content of a layer and are reported through LayerInfo.AddFinding. Their
+// findings are kept in the layer cache, so a cached layer is not read again
+// for them.
+type CacheableAnalyzer interface {
+	Analyzer
+	Cacheable() bool
+}
+
+// BaseAnalyzer implements Analyzer with hooks that do nothing. Embed it to
+// implement only the hooks an analyzer needs.
+type BaseAnalyzer struct{}
+
+func (BaseAnalyzer) OnImageStart(*ImageData) error                    { return nil }
+func (BaseAnalyzer) OnEntry(*LayerInfo, *tar.Header, io.Reader) error { return nil }
+func (BaseAnalyzer) OnLayerEnd(*LayerInfo) error                      { return nil }
+func (BaseAnalyzer) OnImageEnd(*ImageData) error                      { return nil }
+
+// LayerInfo describes the layer being walked.
+type LayerInfo struct {
+	Index       int // position in the manifest, starting at 1
+	Digest      string
+	MediaType   string
+	Size        int64
+	Dir         string // directory for files stored for the layer
+	Compression string
+	Entry       int  // position of the current entry, starting at 0
+	Complete    bool // every entry was read, set before OnLayerEnd
+	Result      *LayerResult
+
+	layer    v1.Layer
+	cache    *LayerCache
+	resume   RangeFunc
+	reserved int64 // download budget reserved for the layer
+}
+
+// Open returns the uncompressed tar stream of the layer, read again from the
+// layer cache. The layer is downloaded again if it was evicted meanwhile.
+func (l *LayerInfo) Open() (io.ReadCloser, error) {
+	rc, err := l.cache.Open(l.layer)
+	if err != nil {
+		return nil, err
+	}
+	uncompressed, _, err := decompress(rc, l.Digest, l.MediaType)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &layerStream{Reader: uncompressed, closers: []io.Closer{uncompressed, rc}}, nil
+}
+
+// layerStream closes the decompressor along with the blob it reads from.
+type layerStream struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *layerStream) Close() error {
+	var err error
+	for _, c := range s.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// AddFinding records a finding about the content of the layer. The finding is
+// added to the image and cached with the layer.
+func (l *LayerInfo) AddFinding(f Finding) {
+	if f.Layer == "" {
+		f.Layer = l.Digest
+	}
+	l.Result.Findings = append(l.Result.Findings, f)
+}
+
+// maxMemoryEntry is the largest entry buffered in memory when several
+// analyzers read it. Larger entries are spooled to a temporary file.
+const maxMemoryEntry = 1 << 20
+
+// LayerProcessor walks the layers of an image and feeds their entries to a
+// set of analyzers.
+type LayerProcessor struct {
+	image     *ImageData
+	options   *StorageOptions
+	tempDir   string
+	analyzers []Analyzer
+	buf       bytes.Buffer
+	spool     *os.File
+	diffIDs   []string // rootfs.diff_ids of the config, by layer index
+	windows   bool     // entries use the Files/ and Hives/ layout
+	limits    LayerLimits
+}
+
+// NewLayerProcessor returns a processor for image. tempDir holds entries that
+// are too large to be buffered in memory.
+func NewLayerProcessor(image *ImageData, options *StorageOptions, tempDir string, analyzers ...Analyzer) *LayerProcessor {
+	p := &LayerProcessor{image: image, options: options, tempDir: tempDir, analyzers: analyzers, limits: options.Limits.withDefaults()}
+	if config, err := v1.ParseConfigFile(strings.NewReader(image.Config)); err == nil {
+		for _, id := range config.RootFS.DiffIDs {
+			p.diffIDs = append(p.diffIDs, id.String())
+		}
+		p.windows = config.OS == "windows"
+	}
+	return p
+}
+
+// Start calls OnImageStart of every analyzer. Analyzers that fail to start
+// are left out for the rest of the image.
+func (p *LayerProcessor) Start() {
+	var started []Analyzer
+	for _, a := range p.analyzers {
+		if err := a.OnImageStart(p.image); err != nil {
+			LogWarn("Analyzer %T disabled for %s: %v", a, p.image.Reference, err)
+			continue
+		}
+		started = append(started, a)
+	}
+	p.analyzers = started
+}
+
+// Finish calls OnImageEnd of every analyzer and releases temporary files.
+func (p *LayerProcessor) Finish() {
+	for _, a := range p.analyzers {
+		if err := a.OnImageEnd(p.image); err != nil {
+			LogWarn("Analyzer %T failed for %s: %v", a, p.image.Reference, err)
+		}
+	}
+	if p.spool != nil {
+		p.spool.Close()
+		os.Remove(p.spool.Name())
+		p.spool = nil
+	}
+}
+
+// ProcessLayer reads layer through the layer cache and hands its entries to
+// the analyzers. Layers whose results are cached are only read for analyzers
+// that are not cacheable.
+func (p *LayerProcessor) ProcessLayer(info *LayerInfo, layer v1.Layer) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to get layer digest: %w", err)
+	}
+	info.Digest = digest.String()
+	info.Result = &LayerResult{Digest: info.Digest, Analyzers: p.cacheable()}
+	info.layer, info.cache = layer, p.options.Cache
+
+	active := p.analyzers
+	cached := p.cachedResult(info.Digest)
+	if cached != nil {
+		useCachedResult(p.image, cached, p.options)
+		p.image.addLayerFiles(info.Index, cached.Files)
+		active = p.uncached()
+		if len(active) == 0 && !p.options.StoreTarballs {
+			return nil
+		}
+	}
+
+	blobPath, err := p.options.Cache.FetchResumable(layer, info.resume)
+	if err != nil {
+		return fmt.Errorf("failed to get compressed stream: %w", err)
+	}
+	rc, err := os.Open(blobPath)
+	if err != nil {
+		return fmt.Errorf("failed to get compressed stream: %w", err)
+	}
+	defer rc.Close()
+
+	var blob io.Reader = rc
+	if p.options.StoreTarballs {
+		tarFile, err := storeTarball(filepath.Join(info.Dir, "filesystem.tar"), rc)
+		if err != nil {
+			return err
+		}
+		defer tarFile.Close()
+		blob = tarFile
+	}
+
+	uncompressed, compression, err := decompress(blob, info.Digest, info.MediaType)
+	if err != nil {
+		return err
+	}
+	defer uncompressed.Close()
+	LogDebug("Layer %s is %s compressed", digest, compression)
+	info.Compression = compression
+	var compressed int64
+	if fi, err := rc.Stat(); err == nil {
+		compressed = fi.Size()
+	}
+	limited := &limitReader{r: uncompressed, limits: p.limits, compressed: compressed}
+	diffID := sha256.New()
+	tarReader := tar.NewReader(io.TeeReader(limited, diffID))
+
+	var readErr error
+	for info.Entry = 0; readErr == nil; info.Entry++ {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			LogInfo("Error reading tar entry: %v", err)
+			readErr = fmt.Errorf("failed reading %s layer: %w", compression, err)
+			break
+		}
+		if readErr = p.limits.checkEntry(int64(info.Entry+1), hdr); readErr != nil {
+			break
+		}
+		if p.windows && !normalizeWindowsEntry(hdr) {
+			continue
+		}
+		readErr = p.entry(active, info, hdr, tarReader)
+	}
+	if readErr == nil {
+		readErr = p.verifyDiffID(info, limited, diffID)
+	}
+
+	info.Complete = readErr == nil
+	for _, a := range active {
+		if err := a.OnLayerEnd(info); err != nil && readErr == nil {
+			readErr = fmt.Errorf("analyzer %T: %w", a, err)
+		}
+	}
+
+	if cached == nil {
+		p.image.addLayerFiles(info.Index, info.Result.Files)
+		for _, f := range info.Result.Findings {
+			f.Image = p.image.Reference
+			p.image.Findings = append(p.image.Findings, f)
+		}
+		if readErr == nil {
+			info.Result.Analyzed = time.Now().UTC()
+			saveLayerResult(info.Result, p.options)
+		}
+	}
+	return readErr
+}
+
+// verifyDiffID reads what is left of the uncompressed stream of the layer
+// after the tar walk and compares its digest with the config's diff_id.
+func (p *LayerProcessor) verifyDiffID(info *LayerInfo, uncompressed io.Reader, h hash.Hash) error {
+	if info.Index < 1 || info.Index > len(p.diffIDs) {
+		return nil
+	}
+	if _, err := io.Copy(h, uncompressed); err != nil {
+		return fmt.Errorf("failed reading %s layer: %w", info.Compression, err)
+	}
+	got := fmt.Sprintf("sha256:%x", h.Sum(nil))
+	if want := p.diffIDs[info.Index-1]; got != want {
+		return &IntegrityError{Kind: IntegrityDiffID, Digest: info.Digest, Want: want, Got: got}
+	}
+	return nil
+}
+
+// uncached returns the analyzers that read a layer even when its results are
+// cached.
+func (p *LayerProcessor) uncached() []Analyzer {
+	var active []Analyzer
+	for _, a := range p.analyzers {
+		if c, ok := a.(CacheableAnalyzer); !ok || !c.Cacheable() {
+			active = append(active, a)
+		}
+	}
+	return active
+}
+
+// cacheable returns the names of the cacheable analyzers, in order.
+func (p *LayerProcessor) cacheable() []string {
+	var names []string
+	for _, a := range p.analyzers {
+		if c, ok := a.(CacheableAnalyzer); ok && c.Cacheable() {
+			names = append(names, analyzerName(a))
+		}
+	}
+	return names
+}
+
+// analyzerName identifies an analyzer in the layer cache by its type.
+func analyzerName(a Analyzer) string {
+	return fmt.Sprintf("%T", a)
+}
+
+// cachedResult returns the cached analysis results of a layer, or nil. Results
+// missing the findings of one of the cacheable analyzers, such as a layer
+// cached before secrets were scanned or before an analyzer was registered,
+// are not used and the layer is analyzed again.
+func (p *LayerProcessor) cachedResult(digest string) *LayerResult {
+	res, ok := p.options.Cache.LoadResult(digest)
+	if !ok {
+		return nil
+	}
+	for _, name := range p.cacheable() {
+		if !slices.Contains(res.Analyzers, name) {
+			return nil
+		}
+	}
+	return res
+}
+
+// needsBlob reports whether ProcessLayer will read the blob of the layer.
+func (p *LayerProcessor) needsBlob(layer v1.Layer) bool {
+	if p.options.StoreTarballs || len(p.uncached()) > 0 {
+		return true
+	}
+	digest, err := layer.Digest()
+	return err != nil || p.cachedResult(digest.String()) == nil
+}
+
+// prefetch downloads the layers into the layer cache in the background, at
+// most workers at a time and in manifest order, so the next layers are ready
+// when the walk reaches them. wait blocks until layer i is downloaded and
+// stop cancels the downloads not started yet.
+func (p *LayerProcessor) prefetch(infos []*LayerInfo, layers []v1.Layer, workers int) (wait func(i int) error, stop func()) {
+	if workers < 1 {
+		workers = 1
+	}
+	done := make([]chan struct{}, len(layers))
+	errs := make([]error, len(layers))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	sem := make(chan struct{}, workers)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range layers {
+			select {
+			case sem <- struct{}{}:
+			case <-quit:
+				for ; i < len(layers); i++ {
+					errs[i] = fmt.Errorf("download cancelled")
+					close(done[i])
+				}
+				return
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem; close(done[i]) }()
+				if p.needsBlob(layers[i]) {
+					_, errs[i] = p.options.Cache.FetchResumable(layers[i], infos[i].resume)
+				}
+			}(i)
+		}
+	}()
+
+	wait = func(i int) error {
+		<-done[i]
+		return errs[i]
+	}
+	stop = func() {
+		close(quit)
+		wg.Wait()
+	}
+	return wait, stop
+}
+
+// entry hands a tar entry to the analyzers. With several analyzers the
+// content of regular files is buffered so each one reads it from the start.
+func (p *LayerProcessor) entry(active []Analyzer, info *LayerInfo, hdr *tar.Header, tr *tar.Reader) error {
+	content := func() io.Reader { return tr }
+	if len(active) > 1 && hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		ra, err := p.buffer(hdr, tr)
+		if err != nil {
+			return fmt.Errorf("failed reading %s: %w", hdr.Name, err)
+		}
+		content = func() io.Reader { return io.NewSectionReader(ra, 0, hdr.Size) }
+	}
+	for _, a := range active {
+		if err := a.OnEntry(info, hdr, content()); err != nil {
+			return fmt.Errorf("analyzer %T: %w", a, err)
+		}
+	}
+	return nil
+}
+
+// buffer reads the content of an entry into memory, or into the spool file
+// when it is large.
+func (p *LayerProcessor) buffer(hdr *tar.Header, r io.Reader) (io.ReaderAt, error) {
+	if hdr.Size <= maxMemoryEntry {
+		p.buf.Reset()
+		if _, err := io.Copy(&p.buf, r); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(p.buf.Bytes()), nil
+	}
+	if p.spool == nil {
+		spool, err := os.CreateTemp(p.tempDir, "entry-")
+		if err != nil {
+			return nil, err
+		}
+		p.spool = spool
+	}
+	if err := p.spool.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := p.spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(p.spool, r); err != nil {
+		return nil, err
+	}
+	return p.spool, nil
+}
+
+// storeTarball copies a layer blob to path and returns the stored copy opened
+// for reading.
+func storeTarball(path string, r io.Reader) (*os.File, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create tarball: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed writing tarball: %w", err)
+	}
+	f.Close()
+
+	tarFile, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reopen tarball: %w", err)
+	}
+	return tarFile, nil
+}
+
+// inventoryAnalyzer records the file list of every layer for the layer cache
+// and the scan database.
+type inventoryAnalyzer struct {
+	BaseAnalyzer
+}
+
+func (inventoryAnalyzer) Cacheable() bool { return true }
+
+func (inventoryAnalyzer) OnEntry(layer *LayerInfo, hdr *tar.Header, _ io.Reader) error {
+	layer.Result.Files = append(layer.Result.Files, newFileEntry(hdr))
+	return nil
+}
@@ -0,0 +1,157 @@
+package pillage
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RecoveredIndexFile indexes the files found by whiteout and shadowed file
+// analysis in an image's results directory, including the ones not restored.
+const RecoveredIndexFile = "recovered.json"
+
+// Filter decisions of a recovered file.
+const (
+	RecoveredKept     = "restored"
+	RecoveredFiltered = "filtered" // matched a --whiteout-filter pattern
+	RecoveredEmpty    = "empty"    // empty file, nothing to restore
+	RecoveredFailed   = "failed"   // could not be read back or written
+)
+
+// LayerRef identifies a layer of an image along with the history command that
+// created it.
+type LayerRef struct {
+	Index     int    `json:"index"`
+	Digest    string `json:"digest,omitempty"`
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+// RecoveredEntry is an entry of recovered.json.
+type RecoveredEntry struct {
+	Path   string `json:"path"`
+	File   string `json:"file,omitempty"` // restored file, relative to the results directory
+	Reason string `json:"reason"`
+	// Layer holds the recovered version of the file, DeletedBy deleted or
+	// overwrote it.
+	Layer     LayerRef `json:"layer"`
+	DeletedBy LayerRef `json:"deletedBy"`
+	SHA256    string   `json:"sha256,omitempty"`
+	Size      int64    `json:"size"`
+	Mode      string   `json:"mode,omitempty"`
+	Type      string   `json:"type,omitempty"`
+	Filter    string   `json:"filter"`
+	Pattern   string   `json:"pattern,omitempty"` // filter pattern that matched
+	// AlsoRecoveredIn lists the other tags of the repository, scanned into
+	// the same output directory before this one, that recovered the same
+	// content at the same path.
+	AlsoRecoveredIn []string `json:"alsoRecoveredIn,omitempty"`
+}
+
+// newRecoveredEntry describes the version of name restored because layer
+// deleted or overwrote it.
+func newRecoveredEntry(name, reason string, version FileVersion, layer int) RecoveredEntry {
+	e := RecoveredEntry{
+		Path:      "/" + name,
+		Reason:    reason,
+		Layer:     LayerRef{Index: version.Layer},
+		DeletedBy: LayerRef{Index: layer},
+		SHA256:    strings.TrimPrefix(version.Digest, "sha256:"),
+		Size:      version.Size,
+		Filter:    RecoveredKept,
+	}
+	if version.Header != nil {
+		e.Mode = version.Header.FileInfo().Mode().String()
+	}
+	if version.TypeFlag == tar.TypeSymlink {
+		e.Type, e.SHA256 = "inode/symlink", ""
+	}
+	return e
+}
+
+// writeRecoveredIndex completes the layer references of the entries and
+// writes them to recovered.json in the image's results directory.
+func writeRecoveredIndex(image *ImageData, dir string, entries []RecoveredEntry, history Attribution) error {
+	ref := func(r *LayerRef) {
+		if h := history.Layer(r.Index); h != nil {
+			r.Digest, r.CreatedBy = h.Digest, h.CreatedBy
+		}
+	}
+	others := siblingRecovered(image, dir)
+	for i := range entries {
+		e := &entries[i]
+		ref(&e.Layer)
+		ref(&e.DeletedBy)
+		if e.SHA256 != "" {
+			e.AlsoRecoveredIn = others[e.Path+"@"+e.SHA256]
+		}
+	}
+	if entries == nil {
+		entries = []RecoveredEntry{}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(dir, RecoveredIndexFile), entries)
+}
+
+// siblingRecovered reads the recovered.json of the other tags of the image's
+// repository and returns the tags that recovered each path and digest.
+func siblingRecovered(image *ImageData, dir string) map[string][]string {
+	found := map[string][]string{}
+	tags, err := os.ReadDir(filepath.Dir(dir))
+	if err != nil {
+		return found
+	}
+	for _, tag := range tags {
+		if !tag.IsDir() || tag.Name() == filepath.Base(dir) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(dir), tag.Name(), RecoveredIndexFile))
+		if err != nil {
+			continue
+		}
+		var entries []RecoveredEntry
+		if json.Unmarshal(data, &entries) != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.SHA256 != "" && e.Filter == RecoveredKept {
+				key := e.Path + "@" + e.SHA256
+				found[key] = append(found[key], image.Repository+":"+tag.Name())
+			}
+		}
+	}
+	for _, refs := range found {
+		sort.Strings(refs)
+	}
+	return found
+}
+
+// detectFileType returns the MIME type of a restored file from its first
+// bytes. Executables, scripts and PEM files are told apart, which the
+// standard library does not.
+func detectFileType(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-elf"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	case bytes.Contains(head, []byte("-----BEGIN ")):
+		return "application/x-pem-file"
+	}
+	mime, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return mime
+}
@@ -0,0 +1,621 @@
+package pillage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ShadowedDir is the directory inside an image's results directory that holds
+// file versions overwritten by a later layer.
+const ShadowedDir = "shadowed"
+
+// MetadataFile lists the files restored into an image's results directory
+// along with their original tar headers.
+const MetadataFile = "metadata.json"
+
+// TarHeader is the original tar header of a restored file.
+type TarHeader struct {
+	Name     string            `json:"name"`
+	Typeflag byte              `json:"typeflag"`
+	Linkname string            `json:"linkname,omitempty"`
+	Size     int64             `json:"size"`
+	Mode     int64             `json:"mode"`
+	Uid      int               `json:"uid"`
+	Gid      int               `json:"gid"`
+	Uname    string            `json:"uname,omitempty"`
+	Gname    string            `json:"gname,omitempty"`
+	ModTime  time.Time         `json:"mtime"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	Xattrs   map[string]string `json:"xattrs,omitempty"`
+}
+
+func newTarHeader(hdr *tar.Header) TarHeader {
+	th := TarHeader{
+		Name:     hdr.Name,
+		Typeflag: hdr.Typeflag,
+		Linkname: hdr.Linkname,
+		Size:     hdr.Size,
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		ModTime:  hdr.ModTime.UTC(),
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if th.Xattrs == nil {
+				th.Xattrs = map[string]string{}
+			}
+			th.Xattrs[name] = v
+		}
+	}
+	return th
+}
+
+// RecoveredFile is a file restored into an image's results directory.
+type RecoveredFile struct {
+	Path   string    `json:"path"`
+	File   string    `json:"file"`
+	Layer  int       `json:"layer"`
+	Reason string    `json:"reason"`
+	Header TarHeader `json:"header"`
+	// CreatedBy added the restored version, DeletedBy deleted or overwrote
+	// it.
+	CreatedBy string `json:"createdBy,omitempty"`
+	DeletedBy string `json:"deletedBy,omitempty"`
+}
+
+// recovery restores the files a layer hides from the layers below it, either
+// by deleting them or by overwriting them, into the image's results directory.
+//
+// Only an index of every file version is kept. The content of the versions to
+// restore is read again from the cached layer blobs once the layer has been
+// walked, reading each layer at most once.
+type recovery struct {
+	image       *ImageData
+	options     *StorageOptions
+	resultsDir  string
+	tempDir     string
+	layerNumber int
+	files       map[string][]FileVersion
+	open        func(layer int) (io.ReadCloser, error)
+	history     Attribution
+	pending     []*pendingRestore
+	index       []RecoveredEntry
+	created     bool
+}
+
+func newRecovery(image *ImageData, options *StorageOptions, tempDir string, layerNumber int, previousFiles map[string][]FileVersion, open func(layer int) (io.ReadCloser, error), history Attribution) *recovery {
+	return &recovery{
+		image:       image,
+		options:     options,
+		resultsDir:  ResultsDir(options.OutputPath, image),
+		tempDir:     tempDir,
+		layerNumber: layerNumber,
+		files:       previousFiles,
+		open:        open,
+		history:     history,
+	}
+}
+
+// pendingRestore is a file version waiting for its content to be read back
+// from the layer holding it.
+type pendingRestore struct {
+	name    string
+	reason  string
+	version FileVersion   // version to restore
+	source  *FileVersion  // entry holding the content, nil for symlinks
+	current *FileVersion  // overwriting version of a shadowed file
+	old     *spooledEntry // content of source once read, for shadowed files
+	need    int           // entries still to be read
+	result  *RecoveredFile
+	entry   RecoveredEntry
+}
+
+// entryRef addresses a tar entry by layer number and position in the layer.
+type entryRef struct {
+	layer, entry int
+}
+
+func (v *FileVersion) ref() entryRef {
+	return entryRef{v.Layer, v.Entry}
+}
+
+// recoveryAnalyzer restores the files hidden by whiteouts and, with
+// --shadowed, the file versions overwritten by a later layer.
+type recoveryAnalyzer struct {
+	BaseAnalyzer
+	options *StorageOptions
+	tempDir string
+	image   *ImageData
+	files   map[string][]FileVersion
+	layers  map[int]*LayerInfo
+	layer   *recovery
+	index   []RecoveredEntry
+	history Attribution
+}
+
+// newRecoveryAnalyzer returns a recovery analyzer spooling the content it
+// reads back from the layers to tempDir.
+func newRecoveryAnalyzer(options *StorageOptions, tempDir string) *recoveryAnalyzer {
+	return &recoveryAnalyzer{options: options, tempDir: tempDir}
+}
+
+func (a *recoveryAnalyzer) OnImageStart(image *ImageData) error {
+	a.image = image
+	a.files = make(map[string][]FileVersion)
+	a.layers = make(map[int]*LayerInfo)
+	a.index = nil
+	a.history = AttributeLayers(image.Manifest, image.Config)
+	return nil
+}
+
+func (a *recoveryAnalyzer) OnEntry(layer *LayerInfo, hdr *tar.Header, r io.Reader) error {
+	if a.layer == nil {
+		a.layers[layer.Index] = layer
+		a.layer = newRecovery(a.image, a.options, a.tempDir, layer.Index, a.files, a.openLayer, a.history)
+	}
+	if isWhiteout(hdr.Name) {
+		if a.options.WhiteOut {
+			a.layer.whiteout(hdr.Name)
+		}
+		return nil
+	}
+	a.layer.track(hdr, layer.Entry, r)
+	return nil
+}
+
+// OnLayerEnd restores the files hidden by the layer.
+func (a *recoveryAnalyzer) OnLayerEnd(*LayerInfo) error {
+	if a.layer != nil {
+		a.layer.flush()
+		a.index = append(a.index, a.layer.index...)
+	}
+	a.layer = nil
+	return nil
+}
+
+func (a *recoveryAnalyzer) openLayer(index int) (io.ReadCloser, error) {
+	layer, ok := a.layers[index]
+	if !ok {
+		return nil, fmt.Errorf("layer %d was not read", index)
+	}
+	return layer.Open()
+}
+
+// OnImageEnd writes the index and the metadata of the restored files.
+func (a *recoveryAnalyzer) OnImageEnd(image *ImageData) error {
+	dir := ResultsDir(a.options.OutputPath, image)
+	if err := writeRecoveredIndex(image, dir, a.index, a.history); err != nil {
+		return fmt.Errorf("failed writing index of recovered files: %w", err)
+	}
+	if len(image.Recovered) == 0 {
+		return nil
+	}
+	if err := writeJSON(filepath.Join(dir, MetadataFile), image.Recovered); err != nil {
+		return fmt.Errorf("failed writing metadata of recovered files: %w", err)
+	}
+	return nil
+}
+
+// track records the entry as the latest version of its path, queueing the
+// version it shadows when --shadowed is enabled. Only the digest of the
+// content is kept.
+func (w *recovery) track(hdr *tar.Header, entry int, r io.Reader) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		LogInfo("Error reading file %s from tar: %v", hdr.Name, err)
+		return
+	}
+
+	name := normalizeEntryPath(hdr.Name)
+	header := *hdr
+	version := FileVersion{
+		Layer:    w.layerNumber,
+		Entry:    entry,
+		Size:     size,
+		TypeFlag: hdr.Typeflag,
+		Digest:   fmt.Sprintf("sha256:%x", h.Sum(nil)),
+		Header:   &header,
+	}
+	if versions := w.files[name]; w.options.Shadowed && len(versions) > 0 && versions[len(versions)-1].Deleted == 0 {
+		w.shadowed(name, versions[len(versions)-1], version)
+	}
+	w.files[name] = append(w.files[name], version)
+}
+
+// shadowed queues the previous version of a regular file whose content was
+// changed by this layer, to be restored along with a unified diff against the
+// new version.
+func (w *recovery) shadowed(name string, previous, current FileVersion) {
+	if previous.TypeFlag != tar.TypeReg || current.TypeFlag != tar.TypeReg || previous.Digest == current.Digest {
+		return
+	}
+	reason := fmt.Sprintf("file shadowed in layer %d", w.layerNumber)
+	entry := newRecoveredEntry(name, reason, previous, w.layerNumber)
+	if pattern := whiteoutFilterMatch(name, w.options); pattern != "" {
+		LogDebug("Skipping filtered shadowed file: %s", name)
+		w.skip(entry, RecoveredFiltered, pattern)
+		return
+	}
+	if previous.Size == 0 {
+		LogDebug("Skipping empty file: %s", name)
+		w.skip(entry, RecoveredEmpty, "")
+		return
+	}
+	w.pending = append(w.pending, &pendingRestore{
+		name:    name,
+		reason:  reason,
+		version: previous,
+		source:  &previous,
+		current: &current,
+		need:    2,
+		entry:   entry,
+	})
+}
+
+// skip records a file that is not restored in the index.
+func (w *recovery) skip(entry RecoveredEntry, decision, pattern string) {
+	entry.Filter, entry.Pattern = decision, pattern
+	w.index = append(w.index, entry)
+}
+
+// restore queues a previous version of a file to be written to
+// <results>/<name>.<layer>. Symlinks are recreated and hardlinks are restored
+// with the content of their target.
+func (w *recovery) restore(name string, version FileVersion, reason string) {
+	if version.TypeFlag == tar.TypeDir {
+		return
+	}
+	entry := newRecoveredEntry(name, reason, version, w.layerNumber)
+	if pattern := whiteoutFilterMatch(name, w.options); pattern != "" {
+		LogDebug("Skipping filtered whiteout file: %s", name)
+		w.skip(entry, RecoveredFiltered, pattern)
+		return
+	}
+	p := &pendingRestore{name: name, reason: reason, version: version}
+	if version.TypeFlag != tar.TypeSymlink || version.Header == nil {
+		source, err := w.source(version)
+		if err != nil {
+			LogInfo("Error restoring %s: %v", name, err)
+			w.skip(entry, RecoveredFailed, "")
+			return
+		}
+		entry.SHA256, entry.Size = strings.TrimPrefix(source.Digest, "sha256:"), source.Size
+		if source.Size == 0 && (version.TypeFlag == tar.TypeReg || version.TypeFlag == tar.TypeLink) {
+			LogDebug("Skipping empty file: %s", name)
+			w.skip(entry, RecoveredEmpty, "")
+			return
+		}
+		p.source, p.need = &source, 1
+	}
+	p.entry = entry
+	w.pending = append(w.pending, p)
+}
+
+// source returns the version holding the content of a file version.
+// Hardlinks resolve to the latest version of their target at the time the
+// link was added.
+func (w *recovery) source(version FileVersion) (FileVersion, error) {
+	if version.TypeFlag == tar.TypeLink && version.Header != nil {
+		target := w.files[normalizeEntryPath(version.Header.Linkname)]
+		for i := len(target) - 1; i >= 0; i-- {
+			if target[i].Layer <= version.Layer && target[i].TypeFlag != tar.TypeLink {
+				return target[i], nil
+			}
+		}
+		return FileVersion{}, fmt.Errorf("hardlink target %s not found", version.Header.Linkname)
+	}
+	return version, nil
+}
+
+// flush reads the content of the queued versions back from their layers and
+// restores them. Every layer is read at most once, in order, and restored
+// files are recorded in the order they were queued.
+func (w *recovery) flush() {
+	wanted := map[int]map[int][]*pendingRestore{}
+	want := func(ref entryRef, p *pendingRestore) {
+		if wanted[ref.layer] == nil {
+			wanted[ref.layer] = map[int][]*pendingRestore{}
+		}
+		wanted[ref.layer][ref.entry] = append(wanted[ref.layer][ref.entry], p)
+	}
+	for _, p := range w.pending {
+		switch {
+		case p.source == nil:
+			w.restoreSymlink(p)
+		case p.current != nil:
+			want(p.source.ref(), p)
+			want(p.current.ref(), p)
+		default:
+			want(p.source.ref(), p)
+		}
+	}
+
+	layers := make([]int, 0, len(wanted))
+	for layer := range wanted {
+		layers = append(layers, layer)
+	}
+	sort.Ints(layers)
+	for _, layer := range layers {
+		if err := w.readLayer(layer, wanted[layer]); err != nil {
+			LogWarn("Failed reading layer %d again to restore files: %v", layer, err)
+		}
+	}
+
+	for _, p := range w.pending {
+		if p.old != nil {
+			p.old.release()
+		}
+		if p.result != nil {
+			w.image.Recovered = append(w.image.Recovered, *p.result)
+		} else {
+			p.entry.Filter = RecoveredFailed
+		}
+		w.index = append(w.index, p.entry)
+	}
+	w.pending = nil
+}
+
+// readLayer hands the wanted entries of a layer to the restores waiting for
+// them. An entry wanted by a single restore is streamed to its destination,
+// other entries are spooled so their size does not bound memory usage.
+func (w *recovery) readLayer(layer int, entries map[int][]*pendingRestore) error {
+	rc, err := w.open(layer)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	remaining := len(entries)
+	for entry := 0; remaining > 0; entry++ {
+		if _, err := tr.Next(); err != nil {
+			return err
+		}
+		waiting, ok := entries[entry]
+		if !ok {
+			continue
+		}
+		remaining--
+		if len(waiting) == 1 && waiting[0].current == nil {
+			w.restoreFile(waiting[0], tr)
+			continue
+		}
+		data, err := w.spool(tr, len(waiting))
+		if err != nil {
+			return err
+		}
+		for _, p := range waiting {
+			switch {
+			case p.current == nil:
+				w.restoreFile(p, data.reader())
+			case p.need > 1:
+				// The previous version of a shadowed file, kept until the
+				// version replacing it is read.
+				p.need--
+				p.old = data
+				continue
+			default:
+				p.need--
+				w.restoreShadowed(p, p.old, data)
+				p.old.release()
+				p.old = nil
+			}
+			data.release()
+		}
+	}
+	return nil
+}
+
+// spooledEntry is the content of a tar entry read by several restores. Large
+// entries are kept in a temporary file, removed once every reader released
+// it.
+type spooledEntry struct {
+	ra   io.ReaderAt
+	size int64
+	file *os.File
+	refs int
+}
+
+// spool reads the content of an entry for refs readers, into memory or into a
+// temporary file when it is larger than maxMemoryEntry.
+func (w *recovery) spool(r io.Reader, refs int) (*spooledEntry, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, maxMemoryEntry+1)
+	if err == io.EOF {
+		return &spooledEntry{ra: bytes.NewReader(buf.Bytes()), size: n, refs: refs}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(w.tempDir, "restore-")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(f, io.MultiReader(&buf, r))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spooledEntry{ra: f, size: size, file: f, refs: refs}, nil
+}
+
+func (s *spooledEntry) reader() io.Reader {
+	return io.NewSectionReader(s.ra, 0, s.size)
+}
+
+// release drops a reader of the entry, removing its temporary file after the
+// last one.
+func (s *spooledEntry) release() {
+	if s.refs--; s.refs == 0 && s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+func (w *recovery) restoreSymlink(p *pendingRestore) {
+	rel := fmt.Sprintf("%s.%d", sanitizeName(p.name), w.layerNumber)
+	if restorePath, ok := w.symlink(rel, p.version.Header.Linkname); ok {
+		w.record(p, rel, restorePath)
+	}
+}
+
+func (w *recovery) restoreFile(p *pendingRestore, r io.Reader) {
+	rel := fmt.Sprintf("%s.%d", sanitizeName(p.name), w.layerNumber)
+	if restorePath, ok := w.write(rel, r); ok {
+		applyHeader(restorePath, p.version.Header)
+		w.record(p, rel, restorePath)
+	}
+}
+
+// restoreShadowed writes the previous version of a shadowed file and a
+// unified diff against the version that replaced it.
+func (w *recovery) restoreShadowed(p *pendingRestore, old, cur *spooledEntry) {
+	rel := filepath.Join(ShadowedDir, fmt.Sprintf("%s.%d", sanitizeName(p.name), w.layerNumber))
+	restorePath, ok := w.write(rel, old.reader())
+	if !ok {
+		return
+	}
+	applyHeader(restorePath, p.version.Header)
+	diff, err := diffContent(
+		fmt.Sprintf("a/%s (layer %d)", p.name, p.version.Layer),
+		fmt.Sprintf("b/%s (layer %d)", p.name, p.current.Layer),
+		old.ra, old.size, cur.ra, cur.size)
+	if err != nil {
+		LogInfo("Error diffing %s: %v", p.name, err)
+	} else {
+		w.write(rel+".diff", strings.NewReader(diff))
+	}
+	w.record(p, rel, restorePath)
+}
+
+// record keeps the restored file for the image's list of recovered files.
+func (w *recovery) record(p *pendingRestore, rel, restorePath string) {
+	rf := &RecoveredFile{
+		Path:      "/" + p.name,
+		File:      filepath.ToSlash(rel),
+		Layer:     w.layerNumber,
+		Reason:    p.reason,
+		CreatedBy: w.history.CreatedBy(p.version.Layer),
+		DeletedBy: w.history.CreatedBy(w.layerNumber),
+	}
+	if p.version.Header != nil {
+		rf.Header = newTarHeader(p.version.Header)
+	}
+	p.result = rf
+	p.entry.File = rf.File
+	if p.entry.Type == "" {
+		p.entry.Type = detectFileType(restorePath)
+	}
+	LogInfo("Restored %s to %s", p.reason, restorePath)
+}
+
+func (w *recovery) ensureResultsDir() bool {
+	if !w.created {
+		if err := os.MkdirAll(w.resultsDir, 0755); err != nil {
+			LogInfo("Failed to create dir for results: %v", err)
+			return false
+		}
+		w.created = true
+	}
+	return true
+}
+
+// write stores the content of r at rel inside the results directory. Restored
+// symlinks are never followed, see safePath.
+func (w *recovery) write(rel string, r io.Reader) (string, bool) {
+	if !w.ensureResultsDir() {
+		return "", false
+	}
+	restorePath, err := safePath(w.resultsDir, filepath.ToSlash(rel))
+	if err != nil {
+		LogInfo("Refusing to restore %s: %v", rel, err)
+		return "", false
+	}
+	if err := os.MkdirAll(filepath.Dir(restorePath), 0755); err != nil {
+		LogInfo("Failed to create dir for %s: %v", restorePath, err)
+		return "", false
+	}
+	os.Remove(restorePath)
+	out, err := os.OpenFile(restorePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err == nil {
+		_, err = io.Copy(out, r)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		LogInfo("Error restoring file %s: %v", restorePath, err)
+		return "", false
+	}
+	return restorePath, true
+}
+
+// symlink recreates a symlink at rel inside the results directory. Where
+// symlinks are not supported, a text file describing the link is written.
+func (w *recovery) symlink(rel, target string) (string, bool) {
+	if !w.ensureResultsDir() {
+		return "", false
+	}
+	restorePath, err := safePath(w.resultsDir, filepath.ToSlash(rel))
+	if err != nil {
+		LogInfo("Refusing to restore %s: %v", rel, err)
+		return "", false
+	}
+	if err := os.MkdirAll(filepath.Dir(restorePath), 0755); err != nil {
+		LogInfo("Failed to create dir for %s: %v", restorePath, err)
+		return "", false
+	}
+	os.Remove(restorePath)
+	if err := os.Symlink(target, restorePath); err != nil {
+		LogDebug("Unable to create symlink %s, describing it instead: %v", restorePath, err)
+		return w.write(rel, strings.NewReader("symlink to "+target+"\n"))
+	}
+	return restorePath, true
+}
+
+// applyHeader gives a restored file the mode, times and, when running as
+// root, the ownership from its original tar header. The owner always keeps
+// read and write access and setuid/setgid bits are dropped.
+func applyHeader(path string, hdr *tar.Header) {
+	if hdr == nil {
+		return
+	}
+	if err := os.Chmod(path, os.FileMode(hdr.Mode).Perm()|0600); err != nil {
+		LogDebug("Failed to set mode of %s: %v", path, err)
+	}
+	if !hdr.ModTime.IsZero() {
+		atime := hdr.AccessTime
+		if atime.IsZero() {
+			atime = hdr.ModTime
+		}
+		if err := os.Chtimes(path, atime, hdr.ModTime); err != nil {
+			LogDebug("Failed to set times of %s: %v", path, err)
+		}
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			LogDebug("Failed to set owner of %s: %v", path, err)
+		}
+	}
+}
+
+// sanitizeName turns a tar entry name into a relative path that cannot escape
+// the results directory.
+func sanitizeName(name string) string {
+	return strings.TrimPrefix(filepath.Clean("/"+name), "/")
+}
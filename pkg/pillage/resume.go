@@ -0,0 +1,96 @@
+package pillage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// maxResumeAttempts is how many times an interrupted layer download is
+// resumed before giving up.
+const maxResumeAttempts = 3
+
+// RangeFunc reads a compressed layer blob starting at offset. It is used to
+// resume a download that was interrupted.
+type RangeFunc func(offset int64) (io.ReadCloser, error)
+
+// registryRange returns a RangeFunc reading the blob digest of size bytes from
+// the repository of ref with HTTP range requests.
+func registryRange(ref, digest string, size int64, opts *StorageOptions) RangeFunc {
+	return func(offset int64) (io.ReadCloser, error) {
+		o := crane.GetOptions(opts.CraneOptions...)
+		r, err := name.ParseReference(ref, o.Name...)
+		if err != nil {
+			return nil, err
+		}
+		repo := r.Context()
+
+		auth := opts.Auth
+		if auth == nil {
+			keychain := o.Keychain
+			if keychain == nil {
+				keychain = authn.DefaultKeychain
+			}
+			if auth, err = keychain.Resolve(repo); err != nil {
+				return nil, err
+			}
+		}
+		base := o.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		ctx := context.Background()
+		rt, err := transport.NewWithContext(ctx, repo.Registry, auth, base, []string{repo.Scope(transport.PullScope)})
+		if err != nil {
+			return nil, err
+		}
+
+		url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), digest)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, size-1))
+		resp, err := (&http.Client{Transport: rt}).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("range request for %s returned %s", digest, resp.Status)
+		}
+		return limitBody(resp.Body, size-offset, "range response for "+digest), nil
+	}
+}
+
+// errTooLarge is returned by a body read past its declared size.
+var errTooLarge = errors.New("larger than its declared size")
+
+// limitedBody fails once a response body goes past the size it should have,
+// so a hostile server cannot fill the disk before the digest is verified.
+type limitedBody struct {
+	io.Closer
+	r    io.Reader
+	left int64
+	what string
+}
+
+// limitBody limits body to n bytes.
+func limitBody(body io.ReadCloser, n int64, what string) io.ReadCloser {
+	return &limitedBody{Closer: body, r: io.LimitReader(body, n+1), left: n, what: what}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if b.left -= int64(n); b.left < 0 {
+		return n + int(b.left), fmt.Errorf("%s is %w", b.what, errTooLarge)
+	}
+	return n, err
+}
@@ -0,0 +1,396 @@
+package pillage
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DBFile is the name of the scan database inside the output directory.
+const DBFile = "pilreg.db"
+
+// Top level buckets of the scan database.
+var (
+	bucketRegistries = []byte("registries") // registry -> repository -> tag = digest
+	bucketImages     = []byte("images")     // reference = ImageRecord
+	bucketManifests  = []byte("manifests")  // digest = raw manifest
+	bucketLayers     = []byte("layers")     // layer digest -> reference = layer index
+	bucketLayerFiles = []byte("layerfiles") // layer digest -> path = FileEntry
+	bucketFiles      = []byte("files")      // path -> layer digest = FileEntry
+	bucketFindings   = []byte("findings")   // reference = []Finding
+)
+
+// FileEntry describes a single tar entry found in a layer.
+type FileEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Mode     int64  `json:"mode"`
+	Type     byte   `json:"type"`
+	Linkname string `json:"linkname,omitempty"`
+	Whiteout bool   `json:"whiteout,omitempty"`
+}
+
+func newFileEntry(hdr *tar.Header) FileEntry {
+	return FileEntry{
+		Path:     normalizeEntryPath(hdr.Name),
+		Size:     hdr.Size,
+		Mode:     hdr.Mode,
+		Type:     hdr.Typeflag,
+		Linkname: hdr.Linkname,
+		Whiteout: strings.HasPrefix(path.Base(hdr.Name), ".wh."),
+	}
+}
+
+// ScanDB is an embedded database recording what was found during scans so
+// results can be queried across runs without rescanning.
+type ScanDB struct {
+	db *bolt.DB
+}
+
+// OpenScanDB opens or creates the scan database at path.
+func OpenScanDB(path string, readOnly bool) (*ScanDB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scan database %s: %w", path, err)
+	}
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, b := range [][]byte{bucketRegistries, bucketImages, bucketManifests, bucketLayers, bucketLayerFiles, bucketFiles, bucketFindings} {
+				if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &ScanDB{db: db}, nil
+}
+
+// Close closes the database.
+func (s *ScanDB) Close() error {
+	return s.db.Close()
+}
+
+// RecordImage stores the image, its manifest, the layers it references and its
+// findings. Recording an image again replaces its previous findings.
+func (s *ScanDB) RecordImage(image *ImageData) error {
+	rec := NewImageRecord(image)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	findings, err := json.Marshal(image.Findings)
+	if err != nil {
+		return err
+	}
+	var manifest Manifest
+	if image.Manifest != "" {
+		if err := json.Unmarshal([]byte(image.Manifest), &manifest); err != nil {
+			LogDebug("Unable to parse manifest of %s for the scan database: %v", image.Reference, err)
+		}
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ref := []byte(image.Reference)
+		if err := tx.Bucket(bucketImages).Put(ref, data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketFindings).Put(ref, findings); err != nil {
+			return err
+		}
+		if image.Registry != "" && image.Repository != "" {
+			reg, err := tx.Bucket(bucketRegistries).CreateBucketIfNotExists([]byte(image.Registry))
+			if err != nil {
+				return err
+			}
+			repo, err := reg.CreateBucketIfNotExists([]byte(image.Repository))
+			if err != nil {
+				return err
+			}
+			if image.Tag != "" {
+				if err := repo.Put([]byte(image.Tag), []byte(image.Digest)); err != nil {
+					return err
+				}
+			}
+		}
+		if image.Digest != "" && image.Manifest != "" {
+			if err := tx.Bucket(bucketManifests).Put([]byte(image.Digest), []byte(image.Manifest)); err != nil {
+				return err
+			}
+		}
+		for idx, layer := range manifest.Layers {
+			b, err := tx.Bucket(bucketLayers).CreateBucketIfNotExists([]byte(layer.Digest))
+			if err != nil {
+				return err
+			}
+			if err := b.Put(ref, []byte(strconv.Itoa(idx+1))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RecordLayerFiles stores the file inventory of a layer.
+func (s *ScanDB) RecordLayerFiles(layerDigest string, files []FileEntry) error {
+	if layerDigest == "" || len(files) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		lf, err := tx.Bucket(bucketLayerFiles).CreateBucketIfNotExists([]byte(layerDigest))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.Path == "" {
+				continue
+			}
+			data, err := json.Marshal(f)
+			if err != nil {
+				return err
+			}
+			if err := lf.Put([]byte(f.Path), data); err != nil {
+				return err
+			}
+			fb, err := tx.Bucket(bucketFiles).CreateBucketIfNotExists([]byte(f.Path))
+			if err != nil {
+				return err
+			}
+			if err := fb.Put([]byte(layerDigest), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LayerUse is an image that references a layer.
+type LayerUse struct {
+	Reference string `json:"reference"`
+	Layer     string `json:"layer"`
+	Index     int    `json:"index"`
+}
+
+// FileMatch is a file found in a layer along with the images using that layer.
+type FileMatch struct {
+	FileEntry
+	Layer  string     `json:"layer"`
+	Images []LayerUse `json:"images"`
+}
+
+// ImagesWithLayer returns the images that reference the layer digest.
+func (s *ScanDB) ImagesWithLayer(digest string) ([]LayerUse, error) {
+	var uses []LayerUse
+	err := s.db.View(func(tx *bolt.Tx) error {
+		uses = layerUses(tx, digest)
+		return nil
+	})
+	return uses, err
+}
+
+// BaseImage returns the recorded image whose layers are the longest prefix of
+// layers that leaves at least one layer, or nil. It is the image the layers
+// were most likely built from.
+func (s *ScanDB) BaseImage(layers []string) (*BaseImage, error) {
+	if len(layers) < 2 {
+		return nil, nil
+	}
+	var base *BaseImage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, use := range layerUses(tx, layers[0]) {
+			if use.Index != 1 {
+				continue
+			}
+			var rec ImageRecord
+			if err := json.Unmarshal(tx.Bucket(bucketImages).Get([]byte(use.Reference)), &rec); err != nil {
+				continue
+			}
+			var m Manifest
+			if err := json.Unmarshal(rec.Manifest, &m); err != nil {
+				continue
+			}
+			n := len(m.Layers)
+			if n >= len(layers) || (base != nil && (n < base.Layers || n == base.Layers && rec.Reference > base.Reference)) {
+				continue
+			}
+			prefix := true
+			for i, l := range m.Layers {
+				if l.Digest != layers[i] {
+					prefix = false
+					break
+				}
+			}
+			if prefix {
+				base = &BaseImage{Reference: rec.Reference, Layers: n, Source: "layers shared with a scanned image"}
+				if cfg, err := v1.ParseConfigFile(bytes.NewReader(rec.Config)); err == nil {
+					base.History = len(cfg.History)
+				}
+			}
+		}
+		return nil
+	})
+	return base, err
+}
+
+func layerUses(tx *bolt.Tx, digest string) []LayerUse {
+	b := tx.Bucket(bucketLayers).Bucket([]byte(digest))
+	if b == nil {
+		return nil
+	}
+	var uses []LayerUse
+	b.ForEach(func(k, v []byte) error {
+		idx, _ := strconv.Atoi(string(v))
+		uses = append(uses, LayerUse{Reference: string(k), Layer: digest, Index: idx})
+		return nil
+	})
+	return uses
+}
+
+// FindFiles returns the layers, and the images using them, that contain a
+// path. The path may be a doublestar glob such as "/root/.ssh/*".
+func (s *ScanDB) FindFiles(pattern string) ([]FileMatch, error) {
+	pattern = normalizeEntryPath(pattern)
+	glob := strings.ContainsAny(pattern, "*?[{")
+	var matches []FileMatch
+	err := s.db.View(func(tx *bolt.Tx) error {
+		files := tx.Bucket(bucketFiles)
+		collect := func(path []byte) error {
+			b := files.Bucket(path)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				var m FileMatch
+				if err := json.Unmarshal(v, &m.FileEntry); err != nil {
+					return err
+				}
+				m.Layer = string(k)
+				m.Images = layerUses(tx, m.Layer)
+				matches = append(matches, m)
+				return nil
+			})
+		}
+		if !glob {
+			return collect([]byte(pattern))
+		}
+		return files.ForEach(func(k, _ []byte) error {
+			if ok, err := doublestar.Match(pattern, string(k)); err != nil || !ok {
+				return err
+			}
+			return collect(k)
+		})
+	})
+	return matches, err
+}
+
+// Images returns every image recorded in the database.
+func (s *ScanDB) Images() ([]ImageRecord, error) {
+	var images []ImageRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketImages).ForEach(func(_, v []byte) error {
+			var rec ImageRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			images = append(images, rec)
+			return nil
+		})
+	})
+	return images, err
+}
+
+// RepositoryImages returns the images recorded for a repository, one per tag
+// or digest.
+func (s *ScanDB) RepositoryImages(registry, repository string) ([]ImageRecord, error) {
+	images, err := s.Images()
+	var repo []ImageRecord
+	for _, rec := range images {
+		if rec.Registry == registry && rec.Repository == repository {
+			repo = append(repo, rec)
+		}
+	}
+	return repo, err
+}
+
+// LayerFiles returns the file inventory recorded for a layer, or nil.
+func (s *ScanDB) LayerFiles(digest string) ([]FileEntry, error) {
+	var files []FileEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLayerFiles).Bucket([]byte(digest))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var f FileEntry
+			if err := json.Unmarshal(v, &f); err != nil {
+				return err
+			}
+			files = append(files, f)
+			return nil
+		})
+	})
+	return files, err
+}
+
+// AddFindings adds findings to the ones recorded for an image, leaving out
+// those it already has.
+func (s *ScanDB) AddFindings(reference string, findings []Finding) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketFindings)
+		var existing []Finding
+		if data := b.Get([]byte(reference)); data != nil {
+			if err := json.Unmarshal(data, &existing); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(mergeFindings(existing, findings))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(reference), data)
+	})
+}
+
+// Findings returns the findings recorded for an image, or for all images when
+// reference is empty.
+func (s *ScanDB) Findings(reference string) ([]Finding, error) {
+	var findings []Finding
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFindings).ForEach(func(k, v []byte) error {
+			if reference != "" && string(k) != reference {
+				return nil
+			}
+			var fs []Finding
+			if err := json.Unmarshal(v, &fs); err != nil {
+				return err
+			}
+			findings = append(findings, fs...)
+			return nil
+		})
+	})
+	sort.SliceStable(findings, func(i, j int) bool {
+		return SeverityRank(findings[i].Severity) < SeverityRank(findings[j].Severity)
+	})
+	return findings, err
+}
+
+// normalizeEntryPath strips the leading "/" or "./" and any trailing "/" so
+// user supplied paths match the names stored in layer tarballs.
+func normalizeEntryPath(p string) string {
+	p = strings.TrimPrefix(p, "./")
+	return strings.Trim(p, "/")
+}
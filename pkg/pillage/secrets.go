@@ -0,0 +1,81 @@
+package pillage
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// maxSecretScanSize is the largest file scanned for secrets by the built-in
+// secret analyzer.
+const maxSecretScanSize = 1 << 20
+
+// secretSource is the source of the findings of the built-in secret analyzer.
+const secretSource = "layer"
+
+// secretRule is a pattern of the built-in secret analyzer.
+type secretRule struct {
+	name     string
+	severity string
+	pattern  *regexp.Regexp
+}
+
+var secretRules = []secretRule{
+	{"private key", SeverityHigh, regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY(?: BLOCK)?-----`)},
+	{"AWS access key", SeverityHigh, regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", SeverityHigh, regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"Slack token", SeverityHigh, regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"password assignment", SeverityMedium, regexp.MustCompile(`(?i)\b(?:password|passwd|secret|api_?key|access_?token)\s*[:=]\s*["']?([^\s"'$<>{}]{6,})`)},
+}
+
+// secretAnalyzer looks for well known secret patterns in the regular files of
+// every layer, including files that a later layer deletes. It runs with
+// StorageOptions.ScanSecrets.
+type secretAnalyzer struct {
+	BaseAnalyzer
+}
+
+func (secretAnalyzer) Cacheable() bool { return true }
+
+func (secretAnalyzer) OnEntry(layer *LayerInfo, hdr *tar.Header, r io.Reader) error {
+	if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 || hdr.Size > maxSecretScanSize || isWhiteout(hdr.Name) {
+		return nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed reading %s: %w", hdr.Name, err)
+	}
+	if bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return nil // binary
+	}
+	for _, f := range scanSecrets(data) {
+		f.Path = "/" + normalizeEntryPath(hdr.Name)
+		layer.AddFinding(f)
+	}
+	return nil
+}
+
+// scanSecrets returns a finding for the first match of every secret rule.
+func scanSecrets(data []byte) []Finding {
+	var findings []Finding
+	for _, rule := range secretRules {
+		m := rule.pattern.FindSubmatch(data)
+		if m == nil {
+			continue
+		}
+		secret := m[0]
+		if len(m) > 1 {
+			secret = m[1]
+		}
+		findings = append(findings, Finding{
+			Type:        FindingSecret,
+			Severity:    rule.severity,
+			Source:      secretSource,
+			Description: fmt.Sprintf("Possible %s in file", rule.name),
+			Secret:      string(secret),
+		})
+	}
+	return findings
+}
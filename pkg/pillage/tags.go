@@ -0,0 +1,239 @@
+package pillage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// RemovedFilesFile lists, in the results directory of a repository, the files
+// of older tags that a later tag no longer has.
+const RemovedFilesFile = "removed.json"
+
+// TagRef identifies a tag of a repository compared by AnalyzeTags.
+type TagRef struct {
+	Tag       string    `json:"tag"`
+	Reference string    `json:"reference"`
+	Digest    string    `json:"digest,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// RemovedFile is a file of a tag that the next tag of the repository does
+// not have. The file, and any secret in it, can still be pulled from the
+// older tag.
+type RemovedFile struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Mode      string    `json:"mode,omitempty"`
+	Layer     string    `json:"layer"` // layer of LastSeen holding the file
+	LastSeen  TagRef    `json:"lastSeen"`
+	RemovedIn TagRef    `json:"removedIn"`
+	Secrets   []Finding `json:"secrets,omitempty"`
+}
+
+// TagAnalysis compares the files of the tags of a repository, oldest first.
+type TagAnalysis struct {
+	Registry   string   `json:"registry"`
+	Repository string   `json:"repository"`
+	Tags       []TagRef `json:"tags"`
+	// Skipped lists the tags left out because the inventory of one of their
+	// layers is neither in the layer cache nor in the scan database.
+	Skipped []string      `json:"skipped,omitempty"`
+	Removed []RemovedFile `json:"removed"`
+}
+
+// AnalyzeTags finds the files that disappear from a repository between tags,
+// e.g. a .env shipped in v1 and dropped in v2. Whiteout analysis only sees
+// files deleted within the layers of one image; here the final filesystem of
+// every tag recorded in db is compared with the next tag, ordered by the
+// created time of their config. The filesystems are built from the layer
+// inventories of the layer cache, or of the scan database, so no layer is
+// downloaded. Secrets that scans found in a removed file are attached to it.
+func AnalyzeTags(db *ScanDB, cache *LayerCache, registry, repository string) (*TagAnalysis, error) {
+	records, err := db.RepositoryImages(registry, repository)
+	if err != nil {
+		return nil, err
+	}
+	a := &TagAnalysis{Registry: registry, Repository: repository, Tags: []TagRef{}, Removed: []RemovedFile{}}
+
+	type tagFiles struct {
+		ref    TagRef
+		tree   *fileTree
+		layers []string
+	}
+	var tags []tagFiles
+	for _, rec := range records {
+		if rec.Error != "" || rec.Tag == "" {
+			continue
+		}
+		var m Manifest
+		if err := json.Unmarshal(rec.Manifest, &m); err != nil || len(m.Layers) == 0 {
+			continue
+		}
+		ref := TagRef{Tag: rec.Tag, Reference: rec.Reference, Digest: rec.Digest}
+		if cfg, err := v1.ParseConfigFile(bytes.NewReader(rec.Config)); err == nil {
+			ref.Created = cfg.Created.Time.UTC()
+		}
+		tree := newFileTree()
+		layers := make([]string, len(m.Layers))
+		for i, l := range m.Layers {
+			layers[i] = l.Digest
+			files, ok := layerInventory(db, cache, l.Digest)
+			if !ok {
+				LogDebug("No inventory of layer %s of %s, leaving the tag out", l.Digest, rec.Reference)
+				tree = nil
+				break
+			}
+			for _, f := range files {
+				tree.add(f.Path, f.Type, entryState(f, i+1))
+			}
+			tree.apply()
+		}
+		if tree == nil {
+			a.Skipped = append(a.Skipped, rec.Tag)
+			continue
+		}
+		tags = append(tags, tagFiles{ref: ref, tree: tree, layers: layers})
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		if !tags[i].ref.Created.Equal(tags[j].ref.Created) {
+			return tags[i].ref.Created.Before(tags[j].ref.Created)
+		}
+		return tags[i].ref.Tag < tags[j].ref.Tag
+	})
+	sort.Strings(a.Skipped)
+
+	for i, tag := range tags {
+		a.Tags = append(a.Tags, tag.ref)
+		if i+1 == len(tags) {
+			break
+		}
+		next := tags[i+1]
+		secrets, err := db.Findings(tag.ref.Reference)
+		if err != nil {
+			return nil, err
+		}
+		var removed []RemovedFile
+		for p, f := range tag.tree.files {
+			if next.tree.files[p] != nil {
+				continue
+			}
+			r := RemovedFile{Path: "/" + p, Size: f.Size, Mode: f.Mode, Layer: tag.layers[f.Layer-1], LastSeen: tag.ref, RemovedIn: next.ref}
+			for _, s := range secrets {
+				if s.Type == FindingSecret && s.Source != tagsSource && s.Path == r.Path && s.Layer == r.Layer {
+					r.Secrets = append(r.Secrets, s)
+				}
+			}
+			removed = append(removed, r)
+		}
+		sort.Slice(removed, func(i, j int) bool { return removed[i].Path < removed[j].Path })
+		a.Removed = append(a.Removed, removed...)
+	}
+	return a, nil
+}
+
+// emptyLayer is the digest of the gzipped empty tarball old builders push for
+// steps without changes. The scan database records no inventory for it.
+const emptyLayer = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+
+// layerInventory returns the files of a layer from the layer cache, or from
+// the scan database.
+func layerInventory(db *ScanDB, cache *LayerCache, digest string) ([]FileEntry, bool) {
+	if digest == emptyLayer {
+		return nil, true
+	}
+	if cache != nil {
+		if res, ok := cache.LoadResult(digest); ok {
+			return res.Files, true
+		}
+	}
+	files, err := db.LayerFiles(digest)
+	return files, err == nil && files != nil
+}
+
+// tagsSource is the source of the findings of AnalyzeTags.
+const tagsSource = "tags"
+
+// Findings returns a finding for every secret of a removed file. It is
+// reported on the tag that removed the file, since the secret is still in
+// the tag before it.
+func (a *TagAnalysis) Findings() []Finding {
+	var findings []Finding
+	for _, r := range a.Removed {
+		for _, s := range r.Secrets {
+			findings = append(findings, Finding{
+				Type:        FindingSecret,
+				Severity:    s.Severity,
+				Source:      tagsSource,
+				Image:       r.RemovedIn.Reference,
+				Path:        r.Path,
+				Layer:       r.Layer,
+				Description: fmt.Sprintf("%s removed in tag %s is still in %s", s.Description, r.RemovedIn.Tag, r.LastSeen.Reference),
+				Secret:      s.Secret,
+			})
+		}
+	}
+	return findings
+}
+
+// Write saves the analysis to removed.json in the results directory of the
+// repository, and adds its findings to the results and scan database records
+// of the tags that removed the secrets.
+func (a *TagAnalysis) Write(outputPath string, db *ScanDB) error {
+	dir := filepath.Join(outputPath, "results", securejoin(a.Registry, a.Repository))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(dir, RemovedFilesFile), a); err != nil {
+		return err
+	}
+
+	byImage := map[string][]Finding{}
+	tags := map[string]string{}
+	for _, f := range a.Findings() {
+		byImage[f.Image] = append(byImage[f.Image], f)
+	}
+	for _, t := range a.Tags {
+		tags[t.Reference] = t.Tag
+	}
+	for ref, findings := range byImage {
+		if err := db.AddFindings(ref, findings); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, securejoin(tags[ref]), FindingsFile)
+		var existing []Finding
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // the tag was scanned into another output directory
+		}
+		if err := json.Unmarshal(data, &existing); err != nil {
+			return fmt.Errorf("invalid %s: %w", path, err)
+		}
+		if err := writeJSON(path, mergeFindings(existing, findings)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeFindings adds the findings not already in existing, as compared by
+// findingKey.
+func mergeFindings(existing, findings []Finding) []Finding {
+	seen := map[string]bool{}
+	for _, f := range existing {
+		seen[findingKey(f)] = true
+	}
+	for _, f := range findings {
+		if k := findingKey(f); !seen[k] {
+			seen[k] = true
+			existing = append(existing, f)
+		}
+	}
+	return existing
+}
@@ -0,0 +1,98 @@
+package pillage
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Whiteout markers used by OCI and AUFS layers. A ".wh.<name>" entry deletes
+// <name> from the lower layers, while an opaque marker hides every lower layer
+// entry of the directory it is in.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// isWhiteout reports whether the tar entry is a whiteout or opaque marker.
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
+
+// whiteout recovers the files hidden by the whiteout entry name.
+func (w *recovery) whiteout(name string) {
+	name = normalizeEntryPath(name)
+	dir, base := path.Dir(name), path.Base(name)
+	if dir == "." {
+		dir = ""
+	}
+
+	if base == whiteoutOpaque {
+		LogDebug("Opaque directory detected: %s", name)
+		w.recoverOpaque(dir)
+		return
+	}
+
+	LogDebug("Whiteout file detected: %s", name)
+	deletedPath := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+
+	// Restore a single file if present
+	if version, ok := w.hide(deletedPath); ok {
+		w.restore(deletedPath, version, "whiteout-deleted file")
+	} else {
+		LogDebug("No previous version found for deleted file %s", deletedPath)
+	}
+
+	// Restore any files contained in a deleted directory
+	for _, name := range sortedPaths(w.files, deletedPath) {
+		if version, ok := w.hide(name); ok {
+			w.restore(name, version, "whiteout-deleted file")
+		}
+	}
+}
+
+// recoverOpaque restores every file below dir that was added by a lower layer.
+// Entries added to dir by the opaque layer itself stay visible.
+func (w *recovery) recoverOpaque(dir string) {
+	reason := fmt.Sprintf("file hidden by opaque dir /%s in layer %d", dir, w.layerNumber)
+	for _, name := range sortedPaths(w.files, dir) {
+		if version, ok := w.hide(name); ok {
+			w.restore(name, version, reason)
+		}
+	}
+}
+
+// hide marks the version of name left visible by the lower layers as deleted
+// by this layer and returns it. ok is false when a lower layer already
+// deleted name, so a file is only recovered by the layer that hides it.
+func (w *recovery) hide(name string) (version FileVersion, ok bool) {
+	versions := w.files[name]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Layer < w.layerNumber {
+			if versions[i].Deleted != 0 {
+				return FileVersion{}, false
+			}
+			versions[i].Deleted = w.layerNumber
+			return versions[i], true
+		}
+	}
+	return FileVersion{}, false
+}
+
+// sortedPaths returns the tracked paths below dir in a stable order. An empty
+// dir selects every path.
+func sortedPaths(previousFiles map[string][]FileVersion, dir string) []string {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	var names []string
+	for name, versions := range previousFiles {
+		if strings.HasPrefix(name, prefix) && len(versions) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
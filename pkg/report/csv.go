@@ -0,0 +1,19 @@
+package report
+
+import "github.com/antitree/go-pillage-registries/pkg/pillage"
+
+// WriteCSV exports the image inventory and findings of the report as
+// images.csv and findings.csv in dir. Empty column lists select all columns.
+func WriteCSV(dir string, r *Report, imageColumns, findingColumns []string) error {
+	w, err := pillage.NewCSVWriter(dir, imageColumns, findingColumns)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for _, img := range r.Images {
+		if err := w.Write(&img.Record, img.Findings); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,61 @@
+package report
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+// funcs are the helpers available to every report template.
+var funcs = map[string]interface{}{
+	"humanSize":  humanSize,
+	"lower":      strings.ToLower,
+	"short":      shortDigest,
+	"redact":     redact,
+	"add":        func(a, b int) int { return a + b },
+	"md":         markdownEscape,
+	"severities": func() []string { return severities },
+}
+
+// WriteHTML renders the report as a single self-contained HTML document.
+// All styles and scripts are inlined so the file can be handed over as is.
+func WriteHTML(w io.Writer, r *Report) error {
+	tmpl, err := template.New("report.html.tmpl").Funcs(funcs).ParseFS(templateFS, "templates/report.html.tmpl")
+	if err != nil {
+		return fmt.Errorf("failed to parse HTML template: %w", err)
+	}
+	return tmpl.Execute(w, r)
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func shortDigest(digest string) string {
+	if i := strings.Index(digest, ":"); i >= 0 && len(digest) > i+13 {
+		return digest[:i+13]
+	}
+	return digest
+}
+
+// redact masks all but the first few characters of a secret.
+func redact(secret string) string {
+	if len(secret) <= 4 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:4] + strings.Repeat("*", min(len(secret)-4, 16))
+}
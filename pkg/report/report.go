@@ -0,0 +1,288 @@
+// Package report builds human readable reports from a pilreg scan output
+// directory. Reports are generated from the files written during the scan, so
+// they can be regenerated at any time without rescanning the registry.
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/antitree/go-pillage-registries/pkg/pillage"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// previewSize is the number of bytes of a recovered file shown in a report.
+const previewSize = 2048
+
+// Report is the data model shared by all report formats.
+type Report struct {
+	Generated  time.Time
+	ScanDir    string
+	Registries []*Registry
+	Images     []*Image
+	Findings   []pillage.Finding
+	// ShowSecrets embeds the plaintext of secret findings in the HTML
+	// report, behind a button. Otherwise only their redacted form is written.
+	ShowSecrets bool
+}
+
+// Registry groups the repositories found on a single registry.
+type Registry struct {
+	Name         string
+	Repositories []*Repository
+	ImageCount   int
+	FindingCount int
+}
+
+// Repository groups the scanned tags of a repository.
+type Repository struct {
+	Name   string
+	Images []*Image
+}
+
+// Image holds everything known about a single scanned image.
+type Image struct {
+	Record    pillage.ImageRecord
+	Dir       string
+	Created   string
+	Layers    []Layer
+	Recovered []RecoveredFile
+	Findings  []pillage.Finding
+}
+
+// Layer describes a manifest layer and the history commands that built it.
+type Layer struct {
+	Index     int
+	Digest    string
+	Size      int64
+	MediaType string
+	CreatedBy []string
+}
+
+// RecoveredFile is a file restored by whiteout analysis.
+type RecoveredFile struct {
+	Path      string
+	Layer     int
+	Size      int64
+	Preview   string
+	Binary    bool
+	Truncated bool
+}
+
+// Load reads the results of a scan from dir.
+func Load(dir string) (*Report, error) {
+	resultsDir := filepath.Join(dir, "results")
+	if _, err := os.Stat(resultsDir); err != nil {
+		return nil, fmt.Errorf("no scan results in %s: %w", dir, err)
+	}
+
+	rep := &Report{Generated: time.Now().UTC(), ScanDir: dir}
+	err := filepath.WalkDir(resultsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != pillage.ImageFile {
+			return nil
+		}
+		img, err := loadImage(filepath.Dir(path))
+		if err != nil {
+			pillage.LogWarn("Skipping %s: %v", path, err)
+			return nil
+		}
+		rep.Images = append(rep.Images, img)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(rep.Images, func(i, j int) bool {
+		return rep.Images[i].Record.Reference < rep.Images[j].Record.Reference
+	})
+	registries := map[string]*Registry{}
+	repositories := map[string]*Repository{}
+	for _, img := range rep.Images {
+		reg, ok := registries[img.Record.Registry]
+		if !ok {
+			reg = &Registry{Name: img.Record.Registry}
+			registries[reg.Name] = reg
+			rep.Registries = append(rep.Registries, reg)
+		}
+		key := reg.Name + "/" + img.Record.Repository
+		repo, ok := repositories[key]
+		if !ok {
+			repo = &Repository{Name: img.Record.Repository}
+			repositories[key] = repo
+			reg.Repositories = append(reg.Repositories, repo)
+		}
+		repo.Images = append(repo.Images, img)
+		reg.ImageCount++
+		reg.FindingCount += len(img.Findings)
+		rep.Findings = append(rep.Findings, img.Findings...)
+	}
+	SortFindings(rep.Findings)
+	return rep, nil
+}
+
+// SortFindings orders findings by severity, then image and path.
+func SortFindings(findings []pillage.Finding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if ra, rb := pillage.SeverityRank(a.Severity), pillage.SeverityRank(b.Severity); ra != rb {
+			return ra < rb
+		}
+		if a.Image != b.Image {
+			return a.Image < b.Image
+		}
+		return a.Path < b.Path
+	})
+}
+
+// Secrets returns the secret findings of the report.
+func (r *Report) Secrets() []pillage.Finding {
+	return filterFindings(r.Findings, pillage.FindingSecret)
+}
+
+// Audit returns the audit findings of the report.
+func (r *Report) Audit() []pillage.Finding {
+	return filterFindings(r.Findings, pillage.FindingAudit)
+}
+
+// Integrity returns the integrity findings of the report: layers and configs
+// that do not match their digests, and blobs missing from the registry.
+func (r *Report) Integrity() []pillage.Finding {
+	return filterFindings(r.Findings, pillage.FindingIntegrity)
+}
+
+// SeverityCounts returns the number of findings per severity.
+func (r *Report) SeverityCounts() map[string]int {
+	counts := map[string]int{}
+	for _, f := range r.Findings {
+		counts[f.Severity]++
+	}
+	return counts
+}
+
+// RecoveredCount returns the number of recovered files across all images.
+func (r *Report) RecoveredCount() int {
+	n := 0
+	for _, img := range r.Images {
+		n += len(img.Recovered)
+	}
+	return n
+}
+
+func filterFindings(findings []pillage.Finding, typ string) []pillage.Finding {
+	var out []pillage.Finding
+	for _, f := range findings {
+		if f.Type == typ {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func loadImage(dir string) (*Image, error) {
+	img := &Image{Dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, pillage.ImageFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &img.Record); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", pillage.ImageFile, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, pillage.FindingsFile)); err == nil {
+		if err := json.Unmarshal(data, &img.Findings); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", pillage.FindingsFile, err)
+		}
+	}
+	SortFindings(img.Findings)
+	img.Layers = layers(&img.Record)
+	if cfg, err := v1.ParseConfigFile(bytes.NewReader(img.Record.Config)); err == nil && !cfg.Created.IsZero() {
+		img.Created = cfg.Created.UTC().Format(time.RFC3339)
+	}
+	img.Recovered, err = recoveredFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// layers pairs the manifest layers with the history entries of the config.
+// Empty layer history entries are attached to the layer that follows them.
+func layers(rec *pillage.ImageRecord) []Layer {
+	var manifest pillage.Manifest
+	if err := json.Unmarshal(rec.Manifest, &manifest); err != nil {
+		return nil
+	}
+	history := pillage.AttributeLayers(string(rec.Manifest), string(rec.Config))
+	out := make([]Layer, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		out[i] = Layer{Index: i + 1, Digest: l.Digest, Size: l.Size, MediaType: l.MediaType, CreatedBy: history[i].Commands}
+	}
+	return out
+}
+
+// recoveredFiles lists the files restored into an image results directory,
+// as indexed by recovered.json. Entries that were filtered or could not be
+// restored are left out, and so are the other files of the directory such as
+// the diffs of shadowed files. Layer is the layer that deleted the file, the
+// number appended to the restored file, e.g. etc/shadow.2.
+func recoveredFiles(dir string) ([]RecoveredFile, error) {
+	data, err := os.ReadFile(filepath.Join(dir, pillage.RecoveredIndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []pillage.RecoveredEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", pillage.RecoveredIndexFile, err)
+	}
+	var files []RecoveredFile
+	for _, e := range entries {
+		if e.Filter != pillage.RecoveredKept || e.File == "" {
+			continue
+		}
+		rf := RecoveredFile{Path: e.Path, Layer: e.DeletedBy.Index, Size: e.Size}
+		path := filepath.Join(dir, filepath.FromSlash(e.File))
+		if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+			rf.Preview, rf.Binary, rf.Truncated = preview(path)
+		}
+		files = append(files, rf)
+	}
+	return files, nil
+}
+
+func preview(path string) (text string, binary, truncated bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, false
+	}
+	defer f.Close()
+	buf := make([]byte, previewSize+1)
+	n, _ := f.Read(buf)
+	if n > previewSize {
+		n = previewSize
+		truncated = true
+	}
+	buf = buf[:n]
+	if truncated {
+		// Do not count a multi-byte rune cut at the preview boundary as binary.
+		for i := 0; i < utf8.UTFMax-1 && len(buf) > 0 && !utf8.Valid(buf); i++ {
+			buf = buf[:len(buf)-1]
+		}
+	}
+	if bytes.IndexByte(buf, 0) >= 0 || !utf8.Valid(buf) {
+		return "", true, truncated
+	}
+	return string(buf), false, truncated
+}
@@ -0,0 +1,56 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/antitree/go-pillage-registries/pkg/pillage"
+)
+
+// severities lists the severity levels in report order.
+var severities = []string{
+	pillage.SeverityCritical,
+	pillage.SeverityHigh,
+	pillage.SeverityMedium,
+	pillage.SeverityLow,
+	pillage.SeverityInfo,
+}
+
+// WriteMarkdown renders the report with the built-in Markdown template.
+func WriteMarkdown(w io.Writer, r *Report) error {
+	data, err := templateFS.ReadFile("templates/report.md.tmpl")
+	if err != nil {
+		return err
+	}
+	return WriteTemplate(w, r, string(data))
+}
+
+// WriteTemplateFile renders the report with a user-provided text/template file.
+func WriteTemplateFile(w io.Writer, r *Report, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read template %s: %w", path, err)
+	}
+	return WriteTemplate(w, r, string(data))
+}
+
+// WriteTemplate renders the report with the given text/template source. The
+// template is executed with a *Report and has access to the same helper
+// functions as the built-in templates.
+func WriteTemplate(w io.Writer, r *Report, text string) error {
+	tmpl, err := template.New("report").Funcs(funcs).Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse template: %w", err)
+	}
+	return tmpl.Execute(w, r)
+}
+
+// markdownEscape makes a value safe to place in a Markdown table cell.
+func markdownEscape(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	s = strings.ReplaceAll(s, "\r", "")
+	return strings.ReplaceAll(s, "\n", "<br>")
+}
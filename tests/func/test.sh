@@ -19,7 +19,7 @@ cleanup() {
   echo "Cleaning up old output..."
   rm -rf ./tmp
   rm -rf results
-  rm -f scanned_shas.log
+  rm -f scanned_shas.log scan_state.jsonl pilreg.db
 }
 
 cleanup